@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var checkConfigCmd = kingpin.Command("check-config", "Check the flags and the metrics files without starting the exporter. Exits with 1 on problems.")
+
+// checkConfigCommand loads the metrics files and checks the flags as the exporter does
+// when starting, reporting every problem found instead of stopping at the first one.
+func checkConfigCommand(command string) bool {
+	if command != checkConfigCmd.FullCommand() {
+		return false
+	}
+	// The problems are printed below, not logged while loading
+	if err := log.Base().SetLevel("fatal"); err != nil {
+		log.Errorln("Error while setting the log level:", err)
+	}
+	problems := []string{}
+	check := func(step func()) { collectProblems(&problems, step) }
+
+	files := []string{*defaultFileMetrics}
+	for _, pattern := range strings.Split(*customMetrics, ",") {
+		if pattern = strings.TrimSpace(pattern); strings.Compare(pattern, "") != 0 {
+			check(func() { files = append(files, customMetricsFiles(pattern)...) })
+		}
+	}
+	definedIn := make(map[string]string)
+	contextIn := make(map[string][]contextUse)
+	for _, file := range files {
+		file := file
+		check(func() { loadMetricsFile(file, definedIn, contextIn) })
+	}
+	// Problems between files, e.g. an unknown dimension, only make sense once all of them are loaded
+	if len(problems) == 0 {
+		check(validateMetrics)
+	}
+	check(func() { maintenanceWindowsFlag() })
+	check(func() { parameterNamesFlag() })
+	check(func() { queryTagFlag() })
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Printf("%d metrics loaded from %d files\n", len(metricsToScrap.Metric), len(metricsFiles))
+	return true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	diffCmd       = kingpin.Command("diff", "Compare the metrics served by two exporters, e.g. before an upgrade. Exits with 1 when they differ.")
+	diffOld       = diffCmd.Arg("old", "URL of the metrics of the reference exporter.").Required().String()
+	diffNew       = diffCmd.Arg("new", "URL of the metrics of the exporter to validate.").Required().String()
+	diffValues    = diffCmd.Flag("values", "Also report series whose value changed.").Bool()
+	diffTolerance = diffCmd.Flag("tolerance", "Relative difference under which values are considered equal.").Default("0").Float64()
+	diffTimeout   = diffCmd.Flag("timeout", "Timeout of each scrape.").Default("30s").Duration()
+)
+
+// series is a sample of a scrape, with the type and help of its metric family.
+type series struct {
+	metricType string
+	help       string
+	value      float64
+}
+
+// diffCommand compares the series served by two exporters and prints the
+// added, removed and changed ones.
+func diffCommand(command string) bool {
+	if command != diffCmd.FullCommand() {
+		return false
+	}
+	before, err := scrapeSeries(*diffOld)
+	if err != nil {
+		log.Fatal("Error while scraping ", *diffOld, ": ", err)
+	}
+	after, err := scrapeSeries(*diffNew)
+	if err != nil {
+		log.Fatal("Error while scraping ", *diffNew, ": ", err)
+	}
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	added, removed, changed := 0, 0, 0
+	for _, key := range keys {
+		previous, inOld := before[key]
+		current, inNew := after[key]
+		switch {
+		case !inOld:
+			fmt.Println("+ " + key)
+			added++
+		case !inNew:
+			fmt.Println("- " + key)
+			removed++
+		case previous.metricType != current.metricType:
+			fmt.Println("~ " + key + " type " + previous.metricType + " -> " + current.metricType)
+			changed++
+		case previous.help != current.help:
+			fmt.Println("~ " + key + " help " + strconv.Quote(previous.help) + " -> " + strconv.Quote(current.help))
+			changed++
+		case *diffValues && !sameValue(previous.value, current.value, *diffTolerance):
+			fmt.Println("~ " + key + " value " + formatValue(previous.value) + " -> " + formatValue(current.value))
+			changed++
+		}
+	}
+	fmt.Printf("%d series added, %d removed, %d changed\n", added, removed, changed)
+	if added+removed+changed > 0 {
+		os.Exit(1)
+	}
+	return true
+}
+
+// scrapeSeries fetches the metrics served at url, by series.
+func scrapeSeries(url string) (map[string]series, error) {
+	client := http.Client{Timeout: *diffTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status " + resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]series)
+	for name, family := range families {
+		metricType := strings.ToLower(family.GetType().String())
+		for _, metric := range family.Metric {
+			add := func(suffix string, value float64, extra ...string) {
+				result[seriesKey(name+suffix, metric.Label, extra...)] = series{metricType, family.GetHelp(), value}
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				for _, bucket := range metric.GetHistogram().Bucket {
+					add("_bucket", float64(bucket.GetCumulativeCount()), "le", formatValue(bucket.GetUpperBound()))
+				}
+				add("_bucket", float64(metric.GetHistogram().GetSampleCount()), "le", "+Inf")
+				add("_sum", metric.GetHistogram().GetSampleSum())
+				add("_count", float64(metric.GetHistogram().GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				for _, quantile := range metric.GetSummary().Quantile {
+					add("", quantile.GetValue(), "quantile", formatValue(quantile.GetQuantile()))
+				}
+				add("_sum", metric.GetSummary().GetSampleSum())
+				add("_count", float64(metric.GetSummary().GetSampleCount()))
+			default:
+				add("", metric.GetUntyped().GetValue())
+			}
+		}
+	}
+	return result, nil
+}
+
+// seriesKey formats a series as in the exposition format, labels sorted by name.
+func seriesKey(name string, labels []*dto.LabelPair, extra ...string) string {
+	pairs := []string{}
+	for _, label := range labels {
+		pairs = append(pairs, label.GetName()+"="+strconv.Quote(label.GetValue()))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sameValue tells whether two values differ by less than tolerance, relatively.
+func sameValue(previous, current, tolerance float64) bool {
+	if previous == current || (math.IsNaN(previous) && math.IsNaN(current)) {
+		return true
+	}
+	return math.Abs(previous-current) <= tolerance*math.Max(math.Abs(previous), math.Abs(current))
+}
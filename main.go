@@ -1,16 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 
@@ -19,10 +42,11 @@ import (
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"gopkg.in/alecthomas/kingpin.v2"
-	//Required for debugging
-	//_ "net/http/pprof"
+	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -30,394 +54,5261 @@ var (
 	Version            = "0.0.0.dev"
 	listenAddress      = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry. (env: LISTEN_ADDRESS)").Default(getEnv("LISTEN_ADDRESS", ":9161")).String()
 	metricPath         = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics. (env: TELEMETRY_PATH)").Default(getEnv("TELEMETRY_PATH", "/metrics")).String()
-	landingPage        = []byte("<html><head><title>DM DB Exporter " + Version + "</title></head><body><h1>DM DB Exporter " + Version + "</h1><p><a href='" + *metricPath + "'>Metrics</a></p></body></html>")
-	defaultFileMetrics = kingpin.Flag("default.metrics", "File with default metrics in a TOML file. (env: DEFAULT_METRICS)").Default(getEnv("DEFAULT_METRICS", "default-metrics.toml")).String()
-	customMetrics      = kingpin.Flag("custom.metrics", "File that may contain various custom metrics in a TOML file. (env: CUSTOM_METRICS)").Default(getEnv("CUSTOM_METRICS", "")).String()
+	landingPage        = []byte("<html><head><title>DM DB Exporter " + Version + "</title></head><body><h1>DM DB Exporter " + Version + "</h1><p><a href='" + *metricPath + "'>Metrics</a></p><p><a href='" + definitionsPath + "'>Metric definitions</a></p></body></html>")
+	defaultFileMetrics = kingpin.Flag("default.metrics", "File with default metrics in a TOML, YAML or JSON file. (env: DEFAULT_METRICS)").Default(getEnv("DEFAULT_METRICS", "default-metrics.toml")).String()
+	customMetrics      = kingpin.Flag("custom.metrics", "Comma-separated list of files, glob patterns or directories that may contain various custom metrics in TOML, YAML or JSON files. (env: CUSTOM_METRICS)").Default(getEnv("CUSTOM_METRICS", "")).String()
 	queryTimeout       = kingpin.Flag("query.timeout", "Query timeout (in seconds). (env: QUERY_TIMEOUT)").Default(getEnv("QUERY_TIMEOUT", "5")).String()
 	maxIdleConns       = kingpin.Flag("database.maxIdleConns", "Number of maximum idle connections in the connection pool. (env: DATABASE_MAXIDLECONNS)").Default(getEnv("DM_MAXIDLECONNS", "0")).Int()
 	maxOpenConns       = kingpin.Flag("database.maxOpenConns", "Number of maximum open connections in the connection pool. (env: DATABASE_MAXOPENCONNS)").Default(getEnv("DM_MAXOPENCONNS", "10")).Int()
+	dataWatchPrimary   = kingpin.Flag("datawatch.primary-dsn", "DSN of the primary instance of a DataWatch pair to compare. (env: DATAWATCH_PRIMARY_DSN)").Default(getEnv("DATAWATCH_PRIMARY_DSN", "")).String()
+	dataWatchStandby   = kingpin.Flag("datawatch.standby-dsn", "DSN of the standby instance of a DataWatch pair to compare. (env: DATAWATCH_STANDBY_DSN)").Default(getEnv("DATAWATCH_STANDBY_DSN", "")).String()
+	enablePprof        = kingpin.Flag("web.enable-pprof", "Serve net/http/pprof handlers on a separate listener. (env: ENABLE_PPROF)").Default(getEnv("ENABLE_PPROF", "false")).Bool()
+	pprofAddress       = kingpin.Flag("web.pprof-address", "Address to listen on for pprof handlers when enabled. (env: PPROF_ADDRESS)").Default(getEnv("PPROF_ADDRESS", "localhost:6060")).String()
+	disableCompression = kingpin.Flag("web.disable-compression", "Disable gzip compression of the metrics response. (env: WEB_DISABLE_COMPRESSION)").Default(getEnv("WEB_DISABLE_COMPRESSION", "false")).Bool()
+	webTimeout         = kingpin.Flag("web.timeout", "Maximum duration of a scrape (in seconds), 0 for no limit. (env: WEB_TIMEOUT)").Default(getEnv("WEB_TIMEOUT", "0")).Int()
+	maxRequests        = kingpin.Flag("web.max-requests", "Maximum number of concurrent scrapes, 0 for no limit. (env: WEB_MAX_REQUESTS)").Default(getEnv("WEB_MAX_REQUESTS", "0")).Int()
+	errorHandling      = kingpin.Flag("web.error-handling", "Whether a failed metric is only logged (continue) or fails the whole scrape with HTTP 500 (http-error). (env: WEB_ERROR_HANDLING)").Default(getEnv("WEB_ERROR_HANDLING", "continue")).Enum("continue", "http-error")
+	systemdWaitForDB   = kingpin.Flag("systemd.wait-for-db", "Only notify systemd of readiness after the first successful database ping. (env: SYSTEMD_WAIT_FOR_DB)").Default(getEnv("SYSTEMD_WAIT_FOR_DB", "false")).Bool()
+	conversionLogEvery = kingpin.Flag("log.conversion-interval", "Minimum interval (in seconds) between two logs of the conversion errors of a metric, 0 to log all of them. (env: LOG_CONVERSION_INTERVAL)").Default(getEnv("LOG_CONVERSION_INTERVAL", "60")).Int()
+	maintenanceWindows = kingpin.Flag("maintenance.windows", "Semicolon-separated daily windows during which the target is in maintenance, e.g. \"Sun 02:00-04:00\". (env: MAINTENANCE_WINDOWS)").Default(getEnv("MAINTENANCE_WINDOWS", "")).String()
+	enableAdminAPI     = kingpin.Flag("web.enable-admin-api", "Serve the admin API, which allows to put the target in maintenance. (env: ENABLE_ADMIN_API)").Default(getEnv("ENABLE_ADMIN_API", "false")).Bool()
+	appName            = kingpin.Flag("database.app-name", "Application name of the sessions of the exporter, unless set in the DSN. (env: DATABASE_APP_NAME)").Default(getEnv("DATABASE_APP_NAME", "dmdb_exporter")).String()
+	killOnTimeout      = kingpin.Flag("query.kill-on-timeout", "Close the session of the exporter still running a query that timed out. (env: QUERY_KILL_ON_TIMEOUT)").Default(getEnv("QUERY_KILL_ON_TIMEOUT", "false")).Bool()
+	autoCommit         = kingpin.Flag("database.auto-commit", "Whether the sessions of the exporter commit automatically, unless set in the DSN. (env: DATABASE_AUTO_COMMIT)").Default(getEnv("DATABASE_AUTO_COMMIT", "true")).Bool()
+	isolationLevel     = kingpin.Flag("database.isolation", "Isolation level of the transaction each query runs in, default for none. (env: DATABASE_ISOLATION)").Default(getEnv("DATABASE_ISOLATION", "default")).Enum("default", "read-uncommitted", "read-committed", "serializable")
+	excludeMetrics     = kingpin.Flag("exclude.metrics", "Comma-separated list of metric contexts not to scrape. (env: EXCLUDE_METRICS)").Default(getEnv("EXCLUDE_METRICS", "")).String()
+	connectionBudget   = kingpin.Flag("database.connection-budget", "Warn at startup when the exporter could open more connections than this, 0 for no check. (env: DATABASE_CONNECTION_BUDGET)").Default(getEnv("DATABASE_CONNECTION_BUDGET", "0")).Int()
+	emitDeprecated     = kingpin.Flag("metrics.emit-deprecated", "Also export metrics under the deprecated names set in aliases. (env: METRICS_EMIT_DEPRECATED)").Default(getEnv("METRICS_EMIT_DEPRECATED", "true")).Bool()
+	webReusePort       = kingpin.Flag("web.reuse-port", "Listen with SO_REUSEPORT, so that a new exporter can take over the address before this one stops. (env: WEB_REUSE_PORT)").Default(getEnv("WEB_REUSE_PORT", "false")).Bool()
+	shutdownTimeout    = kingpin.Flag("web.shutdown-timeout", "Maximum duration (in seconds) to wait for the running scrapes when stopping. (env: WEB_SHUTDOWN_TIMEOUT)").Default(getEnv("WEB_SHUTDOWN_TIMEOUT", "30")).Int()
+	booleanValues      = kingpin.Flag("query.boolean-values", "Convert Y/N, TRUE/FALSE and ON/OFF values of every metric to 1/0. (env: QUERY_BOOLEAN_VALUES)").Default(getEnv("QUERY_BOOLEAN_VALUES", "false")).Bool()
+	cardinalityLearn   = kingpin.Flag("cardinality.learn-duration", "Record the series exported by each metric for this long (in seconds), then write suggested limits to the limits file, 0 to disable. (env: CARDINALITY_LEARN_DURATION)").Default(getEnv("CARDINALITY_LEARN_DURATION", "0")).Int()
+	cardinalityEnforce = kingpin.Flag("cardinality.enforce", "Set the maxseries of the metrics without one from the limits file. (env: CARDINALITY_ENFORCE)").Default(getEnv("CARDINALITY_ENFORCE", "false")).Bool()
+	cardinalityFile    = kingpin.Flag("cardinality.limits-file", "File the limits learned with --cardinality.learn-duration are written to. (env: CARDINALITY_LIMITS_FILE)").Default(getEnv("CARDINALITY_LIMITS_FILE", "cardinality-limits.toml")).String()
+	modulePaths        = kingpin.Flag("web.module-paths", "Also serve the metrics of each metrics file under <telemetry-path>/<file name without extension>. (env: WEB_MODULE_PATHS)").Default(getEnv("WEB_MODULE_PATHS", "false")).Bool()
+	enableSQLLookup    = kingpin.Flag("web.enable-sql-lookup", "Serve the text of the statements behind SQL fingerprint labels. (env: ENABLE_SQL_LOOKUP)").Default(getEnv("ENABLE_SQL_LOOKUP", "false")).Bool()
+	storagePath        = kingpin.Flag("storage.path", "Directory of the state kept across restarts (maintenance set through the admin API, cardinality learning), empty to keep none. (env: STORAGE_PATH)").Default(getEnv("STORAGE_PATH", "")).String()
+	parametersNames    = kingpin.Flag("parameters.names", "Comma-separated list of DM parameters of V$DM_INI to export, e.g. MEMORY_TARGET,MAX_SESSIONS. (env: PARAMETERS_NAMES)").Default(getEnv("PARAMETERS_NAMES", "")).String()
+	queryVars          = kingpin.Flag("query.vars", "Comma-separated list of name=value variables of the request templates, overriding the vars of the metrics files. (env: QUERY_VARS)").Default(getEnv("QUERY_VARS", "")).String()
+	validateQueries    = kingpin.Flag("query.validate", "Prepare every request against the database at startup, to report syntax and privilege errors before the first scrape. (env: QUERY_VALIDATE)").Default(getEnv("QUERY_VALIDATE", "false")).Bool()
+	maxConcurrency     = kingpin.Flag("scrape.max-concurrency", "Maximum number of metrics queried at once in each scrape, 0 for no limit. (env: SCRAPE_MAX_CONCURRENCY)").Default(getEnv("SCRAPE_MAX_CONCURRENCY", "5")).Int()
+	sequential         = kingpin.Flag("scrape.sequential", "Query the metrics one at a time over a single connection to each database. (env: SCRAPE_SEQUENTIAL)").Default(getEnv("SCRAPE_SEQUENTIAL", "false")).Bool()
+	backgroundInterval = kingpin.Flag("scrape.background-interval", "Scrape the database in the background at this interval (in seconds) and serve the last metrics scraped, 0 to scrape on each request. (env: SCRAPE_BACKGROUND_INTERVAL)").Default(getEnv("SCRAPE_BACKGROUND_INTERVAL", "0")).Int()
+	backgroundJitter   = kingpin.Flag("scrape.background-jitter", "Maximum delay (in seconds) added at random to the start of each background scrape. (env: SCRAPE_BACKGROUND_JITTER)").Default(getEnv("SCRAPE_BACKGROUND_JITTER", "0")).Int()
+	minInterval        = kingpin.Flag("scrape.min-interval", "Serve the metrics of the last scrape to the requests arriving less than this (in seconds) after it started, 0 to always scrape. (env: SCRAPE_MIN_INTERVAL)").Default(getEnv("SCRAPE_MIN_INTERVAL", "0")).Int()
+	scrapeOverlap      = kingpin.Flag("scrape.overlap", "Whether a scrape starting while the previous one of the same target is still running waits for it (wait) or serves its last metrics (skip). (env: SCRAPE_OVERLAP)").Default(getEnv("SCRAPE_OVERLAP", "wait")).Enum("wait", "skip")
+	prepareQueries     = kingpin.Flag("query.prepare", "Prepare the requests once per connection and reuse the statements on the next scrapes. (env: QUERY_PREPARE)").Default(getEnv("QUERY_PREPARE", "false")).Bool()
+	scrapeMaxRows      = kingpin.Flag("scrape.max-rows", "Maximum number of rows read by a scrape across all the metrics, 0 for no limit. (env: SCRAPE_MAX_ROWS)").Default(getEnv("SCRAPE_MAX_ROWS", "0")).Int64()
+	scrapeMaxBytes     = kingpin.Flag("scrape.max-bytes", "Maximum size (in bytes) of the values read by a scrape across all the metrics, 0 for no limit. (env: SCRAPE_MAX_BYTES)").Default(getEnv("SCRAPE_MAX_BYTES", "0")).Int64()
+	maxSeries          = kingpin.Flag("scrape.max-series-per-metric", "Maximum number of series a metric exports per scrape, unless set with maxseries, 0 for no limit. (env: SCRAPE_MAX_SERIES_PER_METRIC)").Default(getEnv("SCRAPE_MAX_SERIES_PER_METRIC", "0")).Int64()
+	scrapeTimeout      = kingpin.Flag("scrape.timeout", "Maximum duration (in seconds) of the queries of a scrape, the metrics not queried yet being skipped, 0 for no limit. (env: SCRAPE_TIMEOUT)").Default(getEnv("SCRAPE_TIMEOUT", "0")).Int()
+	slowInterval       = kingpin.Flag("scrape.slow-interval", "Interval (in seconds) at which the metrics of the slow tier are queried, the scrapes in between serving their last metrics. (env: SCRAPE_SLOW_INTERVAL)").Default(getEnv("SCRAPE_SLOW_INTERVAL", "600")).Int()
+	errorLogEvery      = kingpin.Flag("log.error-interval", "Minimum interval (in seconds) between two logs of the same error of a metric, 0 to log all of them. (env: LOG_ERROR_INTERVAL)").Default(getEnv("LOG_ERROR_INTERVAL", "300")).Int()
+	queryTagFormat     = kingpin.Flag("query.tag", "Go template of the comment prefixed to the requests of the metrics, with .Context and .Scrape, empty for none. (env: QUERY_TAG)").Default(getEnv("QUERY_TAG", "dmdb_exporter ctx={{.Context}} scrape={{.Scrape}}")).String()
+	timeoutFactor      = kingpin.Flag("query.timeout-factor", "Time out the request of each metric after this many times its average duration, up to --query.timeout, 0 to always use --query.timeout. (env: QUERY_TIMEOUT_FACTOR)").Default(getEnv("QUERY_TIMEOUT_FACTOR", "0")).Float64()
+	enableDiagnostics  = kingpin.Flag("web.enable-diagnostics", "Serve a snapshot of the state of the exporter to attach to bug reports. (env: ENABLE_DIAGNOSTICS)").Default(getEnv("ENABLE_DIAGNOSTICS", "false")).Bool()
+	excludeGroups      = kingpin.Flag("exclude.groups", "Comma-separated list of metric groups not to scrape. (env: EXCLUDE_GROUPS)").Default(getEnv("EXCLUDE_GROUPS", "")).String()
+	reloadInterval     = kingpin.Flag("metrics.reload-interval", "Interval (in seconds) at which the metrics files are checked for changes and reloaded, 0 to disable. (env: METRICS_RELOAD_INTERVAL)").Default(getEnv("METRICS_RELOAD_INTERVAL", "0")).Int()
+	canaryQuery        = kingpin.Flag("canary.query", "Cheap query run first on every scrape to check that queries work end to end, empty to disable. (env: CANARY_QUERY)").Default(getEnv("CANARY_QUERY", "SELECT 1 FROM DUAL")).String()
+	runCommand         = kingpin.Command("run", "Run the exporter (default).").Default()
 )
 
+// Groups of the default metrics, each scraped unless switched off with --no-collect.<group>.
+// Groups of the custom metrics are switched off with --exclude.groups.
+var collectGroups = map[string]*bool{
+	"sessions":   kingpin.Flag("collect.sessions", "Scrape the metrics of group sessions. (env: COLLECT_SESSIONS)").Default(getEnv("COLLECT_SESSIONS", "true")).Bool(),
+	"tablespace": kingpin.Flag("collect.tablespace", "Scrape the metrics of group tablespace. (env: COLLECT_TABLESPACE)").Default(getEnv("COLLECT_TABLESPACE", "true")).Bool(),
+	"system":     kingpin.Flag("collect.system", "Scrape the metrics of group system. (env: COLLECT_SYSTEM)").Default(getEnv("COLLECT_SYSTEM", "true")).Bool(),
+}
+
 // Metric name parts.
 const (
 	namespace = "dmdb"
 	exporter  = "exporter"
 )
 
-// Metrics object description
-type Metric struct {
-	Context          string
-	Labels           []string
-	MetricsDesc      map[string]string
-	MetricsType      map[string]string
-	FieldToAppend    string
-	Request          string
-	IgnoreZeroResult bool
-}
+// Path under which the loaded metric definitions are exposed as JSON.
+const definitionsPath = "/metric-definitions"
 
-// Used to load multiple metrics from file
-type Metrics struct {
-	Metric []Metric
-}
+// Path of the admin API showing, starting and ending a maintenance.
+const maintenancePath = "/api/v1/maintenance"
 
-// Metrics to scrap. Use external file (default-metrics.toml and custom if provided)
-var (
-	metricsToScrap    Metrics
-	additionalMetrics Metrics
+// Path under which the last state of each target is exposed as JSON.
+const statusPath = "/api/v1/status"
+
+// Path under which the text of a statement is served by fingerprint, e.g. /api/v1/sql/3f2a9c0d4e5b6a71.
+const sqlPath = "/api/v1/sql/"
+
+// Path under which a snapshot of the state of the exporter is exposed as JSON for bug reports.
+const diagnosticsPath = "/api/v1/diagnostics"
+
+// Column types that can be declared in columntypes. String columns are never parsed as values.
+const (
+	columnNumber = "number"
+	columnString = "string"
 )
 
-// Exporter collects DmService DB metrics. It implements prometheus.Collector.
-type Exporter struct {
-	dsn             string
-	duration, error prometheus.Gauge
-	totalScrapes    prometheus.Counter
-	scrapeErrors    *prometheus.CounterVec
-	up              prometheus.Gauge
-	db              *sql.DB
-}
+// Formats of textual values that can be declared in format.
+const (
+	formatDuration  = "duration"
+	formatTimestamp = "timestamp"
+)
 
-// getEnv returns the value of an environment variable, or returns the provided fallback value
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-	return fallback
+// What to do with NULL values, set in nullpolicy. By default they fail like other invalid values.
+const (
+	nullSkip = "skip"
+	nullZero = "zero"
+	nullNaN  = "nan"
+)
+
+// What to do when a request returns more rows than maxrows: fail the metric (default) or
+// only export the first rows.
+const (
+	maxRowsError    = "error"
+	maxRowsTruncate = "truncate"
+)
+
+// Base units that can be set in unit, added as suffix to the metric names.
+var baseUnits = map[string]bool{
+	"seconds": true, "bytes": true, "ratio": true, "celsius": true, "meters": true,
+	"volts": true, "amperes": true, "joules": true, "grams": true,
 }
 
+// Suffixes of names in other units than the base ones, to be converted with scale.
+var nonBaseUnits = regexp.MustCompile(`_(ms|us|ns|milliseconds|microseconds|minutes|hours|days|kb|mb|gb|kilobytes|megabytes|gigabytes|pages|percent|pct)$`)
 
+// errScrapeTimeout fails the metrics not queried yet when a scrape reaches --scrape.timeout.
+var errScrapeTimeout = errors.New("scrape timed out before querying the metric, see --scrape.timeout")
 
-func connect(dsn string) *sql.DB {
-	log.Debugln("Launching connection: ", dsn)
+// errQueryTimeout fails the requests lasting more than their timeout, see --query.timeout.
+var errQueryTimeout = errors.New("DM query timed out")
 
-	//db, err := sql.Open("dm", "dm://SYSDBA:SYSDBA@172.20.58.135:5236?autoCommit=true")
-	db, err := sql.Open("dm", dsn)
+// errMaxRows stops reading the rows of a request at maxrows.
+var errMaxRows = errors.New("maximum number of rows reached")
 
-	if err != nil {
-		log.Errorln("Error while connecting to", dsn)
-		panic(err)
-	}
-	log.Debugln("set max idle connections to ", *maxIdleConns)
-	db.SetMaxIdleConns(*maxIdleConns)
-	log.Debugln("set max open connections to ", *maxOpenConns)
-	db.SetMaxOpenConns(*maxOpenConns)
-	log.Debugln("Successfully connected to: ", dsn)
-	return db
-}
+// errBudget stops reading the rows of a request once the scrape read more than
+// --scrape.max-rows or --scrape.max-bytes.
+var errBudget = errors.New("scrape budget exceeded")
 
-// NewExporter returns a new DmService DB exporter for the provided DSN.
-func NewExporter(dsn string) *Exporter {
-	db := connect(dsn)
-	return &Exporter{
-		dsn: dsn,
-		duration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: exporter,
-			Name:      "last_scrape_duration_seconds",
-			Help:      "Duration of the last scrape of metrics from DM DB.",
-		}),
-		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: exporter,
-			Name:      "scrapes_total",
-			Help:      "Total number of times DM DB was scraped for metrics.",
-		}),
-		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: exporter,
-			Name:      "scrape_errors_total",
-			Help:      "Total number of times an error occured scraping a DM database.",
-		}, []string{"collector"}),
-		error: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: exporter,
-			Name:      "last_scrape_error",
-			Help:      "Whether the last scrape of metrics from DM DB resulted in an error (1 for error, 0 for success).",
-		}),
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Whether the DM database server is up.",
-		}),
-		db: db,
-	}
+// errOverBudget fails the metrics stopped by errBudget. They are not retried.
+var errOverBudget = errors.New("the scrape read more than its budget, see --scrape.max-rows and --scrape.max-bytes")
+
+// scrapeBudget counts the rows and bytes read by a scrape, shared by its requests.
+type scrapeBudget struct {
+	rows  int64
+	bytes int64
 }
 
-// Describe describes all the metrics exported by the DM DB exporter.
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	metricCh := make(chan prometheus.Metric)
-	doneCh := make(chan struct{})
+// budgetKey is the context key of the budget of a scrape.
+type budgetKey struct{}
 
-	go func() {
-		for m := range metricCh {
-			ch <- m.Desc()
-		}
-		close(doneCh)
-	}()
+// timeoutKey is the context key of the timeout of a request, set with --query.timeout-factor.
+type timeoutKey struct{}
 
-	e.Collect(metricCh)
-	close(metricCh)
-	<-doneCh
+// Moving average of the duration of the requests, each new duration weighing durationWeight.
+// The timeout of a request only follows its average once it ran adaptiveSamples times, and
+// is never shorter than minAdaptiveTimeout seconds.
+const (
+	durationWeight     = 0.2
+	adaptiveSamples    = 5
+	minAdaptiveTimeout = 1.0
+)
 
-}
+// Text of NULL columns in rows, see columnValue.
+const nullValue = "<nil>"
 
-// Collect implements prometheus.Collector.
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.scrape(ch)
-	ch <- e.duration
-	ch <- e.totalScrapes
-	ch <- e.error
-	e.scrapeErrors.Collect(ch)
-	ch <- e.up
-}
+// Levels at which conversion errors of a metric can be logged.
+const (
+	conversionLogError = "error"
+	conversionLogDebug = "debug"
+)
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
-	e.totalScrapes.Inc()
-	var err error
-	defer func(begun time.Time) {
-		e.duration.Set(time.Since(begun).Seconds())
-		if err == nil {
-			e.error.Set(0)
-		} else {
-			e.error.Set(1)
-		}
-	}(time.Now())
+// Tiers of the metrics, set with tier. Critical metrics are queried first, slow ones at most
+// every --scrape.slow-interval. Metrics without tier are normal.
+const (
+	tierCritical = "critical"
+	tierNormal   = "normal"
+	tierSlow     = "slow"
+)
 
-	if err = e.db.Ping(); err != nil {
-		if strings.Contains(err.Error(), "sql: database is closed") {
-			log.Infoln("Reconnecting to DB")
-			e.db = connect(e.dsn)
-		}
-	}
-	if err = e.db.Ping(); err != nil {
-		log.Errorln("Error pinging dm db:", err)
-		//e.db.Close()
-		e.up.Set(0)
-		return
-	} else {
-		log.Debugln("Successfully pinged DM database: ")
-		e.up.Set(1)
-	}
-	
-	wg := sync.WaitGroup{}
+// Instance roles a metric can be restricted to. A metric without role, or with role any, runs on both.
+const (
+	rolePrimary = "primary"
+	roleStandby = "standby"
+	roleAny     = "any"
+)
 
-	for _, metric := range metricsToScrap.Metric {
-		wg.Add(1)
-		metric := metric  //https://golang.org/doc/faq#closures_and_goroutines
-		
-		go func() {
-			defer wg.Done()
-			
-			log.Debugln("About to scrape metric: ")
-			log.Debugln("- Metric MetricsDesc: ", metric.MetricsDesc)
-			log.Debugln("- Metric Context: ", metric.Context)
-			log.Debugln("- Metric MetricsType: ", metric.MetricsType)
-			log.Debugln("- Metric Labels: ", metric.Labels)
-			log.Debugln("- Metric FieldToAppend: ", metric.FieldToAppend)
-			log.Debugln("- Metric IgnoreZeroResult: ", metric.IgnoreZeroResult)
-			log.Debugln("- Metric Request: ", metric.Request)
+// Metrics object description
+type Metric struct {
+	Context          string                       `json:"context"`
+	Namespace        *string                      `json:"namespace,omitempty"`
+	Subsystem        *string                      `json:"subsystem,omitempty"`
+	Labels           []string                     `json:"labels,omitempty"`
+	MetricsDesc      map[string]string            `json:"metricsdesc"`
+	MetricsType      map[string]string            `json:"metricstype,omitempty"`
+	FieldToAppend    columnList                   `json:"fieldtoappend,omitempty"`
+	Request          string                       `json:"request"`
+	RequestFile      string                       `json:"requestfile,omitempty"`
+	QueryRef         string                       `json:"queryref,omitempty"`
+	IgnoreZeroResult bool                         `json:"ignorezeroresult"`
+	IgnoreErrors     bool                         `json:"ignoreerrors,omitempty"`
+	Role             string                       `json:"role,omitempty"`
+	Group            string                       `json:"group,omitempty"`
+	Tier             string                       `json:"tier,omitempty"`
+	DependsOn        *Dependency                  `json:"dependson,omitempty"`
+	Condition        string                       `json:"condition,omitempty"`
+	ExemplarLabels   []string                     `json:"exemplarlabels,omitempty"`
+	Schedule         []string                     `json:"schedule,omitempty"`
+	Blackout         []string                     `json:"blackout,omitempty"`
+	FreshnessColumn  string                       `json:"freshnesscolumn,omitempty"`
+	MaxAge           int64                        `json:"maxage,omitempty"`
+	Dimensions       []string                     `json:"dimensions,omitempty"`
+	ColumnTypes      map[string]string            `json:"columntypes,omitempty"`
+	ConversionLog    string                       `json:"conversionlog,omitempty"`
+	Override         bool                         `json:"override,omitempty"`
+	Enabled          *bool                        `json:"enabled,omitempty"`
+	ConstLabels      map[string]string            `json:"constlabels,omitempty"`
+	MetricsBuckets   map[string]map[string]string `json:"metricsbuckets,omitempty"`
+	TimestampColumn  string                       `json:"timestampcolumn,omitempty"`
+	InfoLabels       map[string][]string          `json:"infolabels,omitempty"`
+	Aliases          map[string]string            `json:"aliases,omitempty"`
+	ValueMap         map[string]map[string]string `json:"valuemap,omitempty"`
+	Scale            map[string]string            `json:"scale,omitempty"`
+	BooleanValues    bool                         `json:"booleanvalues,omitempty"`
+	Format           map[string]string            `json:"format,omitempty"`
+	TimeLayout       string                       `json:"timelayout,omitempty"`
+	TimeZone         string                       `json:"timezone,omitempty"`
+	StrictValues     bool                         `json:"strictvalues,omitempty"`
+	NullPolicy       string                       `json:"nullpolicy,omitempty"`
+	Fingerprints     []string                     `json:"fingerprints,omitempty"`
+	MinVersion       string                       `json:"minversion,omitempty"`
+	MaxVersion       string                       `json:"maxversion,omitempty"`
+	MaxRows          int64                        `json:"maxrows,omitempty"`
+	MaxRowsAction    string                       `json:"maxrowsaction,omitempty"`
+	MaxSeries        int64                        `json:"maxseries,omitempty"`
+	Retries          int64                        `json:"retries,omitempty"`
+	RetryDelay       string                       `json:"retrydelay,omitempty"`
+	Sanitize         *Sanitize                    `json:"sanitize,omitempty"`
+	Unit             map[string]string            `json:"unit,omitempty"`
+	scheduleWindows  []timeWindow
+	blackoutWindows  []timeWindow
+	scaleFactors     map[string]float64
+	requestPath      string
+	retryDelay       time.Duration
+	timeLocation     *time.Location
+	module           string
+}
 
-			if len(metric.Request) == 0 {
-				log.Errorln("Error scraping for ", metric.MetricsDesc, ". Did you forget to define request in your toml file?")
-			}
+// timeWindow is a daily time range such as "Mon-Fri 09:00-18:00", optionally
+// restricted to some weekdays. A range ending before it starts spans midnight.
+type timeWindow struct {
+	days       map[time.Weekday]bool
+	start, end int
+}
 
-			if len(metric.MetricsDesc) == 0 {
-				log.Errorln("Error scraping for query", metric.Request, ". Did you forget to define metricsdesc  in your toml file?")
-			}
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
 
-			if err = ScrapeMetric(e.db, ch, metric); err != nil {
-				log.Errorln("Error scraping for", metric.Context, "_", metric.MetricsDesc, ":", err)
-				e.scrapeErrors.WithLabelValues(metric.Context).Inc()
-			} else {
-				log.Debugln("Successfully scrapped metric: ", metric.Context)
-			}
-		}()
-	}
-	wg.Wait()
+// Dependency makes a metric run only after every metric of another context
+// succeeded in the same scrape and, when Metric is set, only if the sum of the
+// values of that column is above the given threshold.
+type Dependency struct {
+	Context string    `json:"context"`
+	Metric  string    `json:"metric,omitempty"`
+	Above   threshold `json:"above,omitempty"`
 }
 
-func GetMetricType(metricType string, metricsType map[string]string) prometheus.ValueType {
-	var strToPromType = map[string]prometheus.ValueType{
-		"gauge":   prometheus.GaugeValue,
-		"counter": prometheus.CounterValue,
-	}
+// threshold is a number that TOML files can write as an integer, e.g. above = 100,
+// which the TOML decoder otherwise refuses for a float.
+type threshold float64
 
-	strType, ok := metricsType[strings.ToLower(metricType)]
-	if !ok {
-		return prometheus.GaugeValue
-	}
-	valueType, ok := strToPromType[strings.ToLower(strType)]
-	if !ok {
-		panic(errors.New("Error while getting prometheus type " + strings.ToLower(strType)))
+// UnmarshalTOML implements toml.Unmarshaler.
+func (t *threshold) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case int64:
+		*t = threshold(value)
+	case float64:
+		*t = threshold(value)
+	default:
+		return fmt.Errorf("expected a number but found %T", data)
 	}
-	return valueType
+	return nil
 }
 
-// interface method to call ScrapeGenericValues using Metric struct values
-func ScrapeMetric(db *sql.DB, ch chan<- prometheus.Metric, metricDefinition Metric) error {
-	log.Debugln("Calling function ScrapeGenericValues()")
-	return ScrapeGenericValues(db, ch, metricDefinition.Context, metricDefinition.Labels,
-		metricDefinition.MetricsDesc, metricDefinition.MetricsType,
-		metricDefinition.FieldToAppend, metricDefinition.IgnoreZeroResult,
-		metricDefinition.Request)
+// Used to load multiple metrics from file
+type Metrics struct {
+	Metric    []Metric
+	Dimension []Dimension
+	Query     []Query
+	// Default sanitization of the metrics of the file without their own.
+	Sanitize *Sanitize
+	// Variables of the request templates of the file, overridden by --query.vars.
+	Vars map[string]string
 }
 
-// generic method for retrieving metrics.
-func ScrapeGenericValues(db *sql.DB, ch chan<- prometheus.Metric, context string, labels []string,
-	metricsDesc map[string]string, metricsType map[string]string, fieldToAppend string, ignoreZeroResult bool, request string) error {
-	metricsCount := 0
-	genericParser := func(row map[string]string) error {
-		// Construct labels value
-		labelsValues := []string{}
-		for _, label := range labels {
-			labelsValues = append(labelsValues, row[label])
-		}
-		// Construct Prometheus values to sent back
-		for metric, metricHelp := range metricsDesc {
-			value, err := strconv.ParseFloat(strings.TrimSpace(row[metric]), 64)
-			// If not a float, skip current metric
-			if err != nil {
-				log.Errorln("Unable to convert current value to float (metric=" + metric +
-					",metricHelp=" + metricHelp + ",value=<" + row[metric] + ">)")
-				continue
-			}
-			log.Debugln("Query result looks like: ", value)
-			// If metric do not use a field content in metric's name
-			if strings.Compare(fieldToAppend, "") == 0 {
-				desc := prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, context, metric),
-					metricHelp,
-					labels, nil,
-				)
-				ch <- prometheus.MustNewConstMetric(desc, GetMetricType(metric, metricsType), value, labelsValues...)
-				// If no labels, use metric name
-			} else {
-				desc := prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, context, cleanName(row[fieldToAppend])),
-					metricHelp,
-					nil, nil,
-				)
-				ch <- prometheus.MustNewConstMetric(desc, GetMetricType(metric, metricsType), value)
+// columnList is a list of columns, which can also be written as a single column.
+type columnList []string
+
+// UnmarshalTOML reads a column or a list of columns in TOML.
+func (l *columnList) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*l = columnList{value}
+	case []interface{}:
+		columns := columnList{}
+		for _, column := range value {
+			name, ok := column.(string)
+			if !ok {
+				return fmt.Errorf("expected a column name but found %T", column)
 			}
-			metricsCount++
+			columns = append(columns, name)
 		}
+		*l = columns
+	default:
+		return fmt.Errorf("expected a column name or a list of column names but found %T", data)
+	}
+	return nil
+}
+
+// UnmarshalYAML reads a column or a list of columns in YAML.
+func (l *columnList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var column string
+	if err := unmarshal(&column); err == nil {
+		*l = columnList{column}
 		return nil
 	}
-	err := GeneratePrometheusMetrics(db, genericParser, request)
-	log.Debugln("ScrapeGenericValues() - metricsCount: ", metricsCount)
-	if err != nil {
+	var columns []string
+	if err := unmarshal(&columns); err != nil {
 		return err
 	}
-	if !ignoreZeroResult && metricsCount == 0 {
-		return errors.New("No metrics found while parsing")
-	}
-	return err
+	*l = columns
+	return nil
 }
 
-// inspired by https://kylewbanks.com/blog/query-result-to-map-in-golang
-// Parse SQL result and call parsing function to each row
-func GeneratePrometheusMetrics(db *sql.DB, parse func(row map[string]string) error, query string) error {
-
-	// Add a timeout
-	timeout, err := strconv.Atoi(*queryTimeout)
-	if err != nil {
-		log.Fatal("error while converting timeout option value: ", err)
-		panic(err)
+// UnmarshalJSON reads a column or a list of columns in JSON.
+func (l *columnList) UnmarshalJSON(data []byte) error {
+	var column string
+	if err := json.Unmarshal(data, &column); err == nil {
+		*l = columnList{column}
+		return nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	defer cancel()
-	rows, err := db.QueryContext(ctx, query)
-
-	if ctx.Err() == context.DeadlineExceeded {
-		return errors.New("DM query timed out")
+	var columns []string
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return err
 	}
+	*l = columns
+	return nil
+}
 
-	if err != nil {
-		return err
+// MarshalJSON writes a single column as a string, as it is usually written.
+func (l columnList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
 	}
-	cols, err := rows.Columns()
-	defer rows.Close()
+	return json.Marshal([]string(l))
+}
 
-	for rows.Next() {
-		// Create a slice of interface{}'s to represent each column,
-		// and a second slice to contain pointers to each item in the columns slice.
-		columns := make([]interface{}, len(cols))
-		columnPointers := make([]interface{}, len(cols))
-		for i, _ := range columns {
-			columnPointers[i] = &columns[i]
-		}
+// Sanitize cleans the metric names built from fieldtoappend and the values of the listed
+// labels: the replacements are applied in order, then the value is lowercased (unless
+// lowercase is false) and cut to maxlength characters.
+type Sanitize struct {
+	Replace   []Replacement `json:"replace,omitempty"`
+	Lowercase *bool         `json:"lowercase,omitempty"`
+	MaxLength int           `json:"maxlength,omitempty"`
+	Labels    []string      `json:"labels,omitempty"`
+}
 
-		// Scan the result into the column pointers...
-		if err := rows.Scan(columnPointers...); err != nil {
-			return err
-		}
+// Replacement replaces the matches of a regular expression, which can reference its groups as $1.
+type Replacement struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	regexp      *regexp.Regexp
+}
 
-		// Create our map, and retrieve the value for each column from the pointers slice,
-		// storing it in the map with the name of the column as the key.
-		m := make(map[string]string)
-		for i, colName := range cols {
-			val := columnPointers[i].(*interface{})
-			m[strings.ToLower(colName)] = fmt.Sprintf("%v", *val)
-		}
-		// Call function to parse row
-		if err := parse(m); err != nil {
-			return err
-		}
+// apply runs the pipeline on a value. Without pipeline, names are cleaned with cleanName.
+func (s *Sanitize) apply(value string) string {
+	if s == nil {
+		return cleanName(value)
 	}
+	for _, replacement := range s.Replace {
+		value = replacement.regexp.ReplaceAllString(value, replacement.Replacement)
+	}
+	if s.Lowercase == nil || *s.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if s.MaxLength > 0 && utf8.RuneCountInString(value) > s.MaxLength {
+		value = string([]rune(value)[:s.MaxLength])
+	}
+	return value
+}
 
-	return nil
+// Query is a named request run at most once per scrape, whose rows are shared by the
+// metrics referencing it with queryref, each of them reading its own columns.
+type Query struct {
+	Name    string `json:"name"`
+	Request string `json:"request"`
+}
 
+// Dimension is a lookup query, run at most once per scrape, whose Labels columns
+// are joined onto the rows of the metrics listing it by the value of the Key column.
+type Dimension struct {
+	Name    string   `json:"name"`
+	Key     string   `json:"key"`
+	Labels  []string `json:"labels"`
+	Request string   `json:"request"`
 }
 
-// DB gives us some ugly names back. This function cleans things up for Prometheus.
-func cleanName(s string) string {
-	s = strings.Replace(s, " ", "_", -1) // Remove spaces
-	s = strings.Replace(s, "(", "", -1)  // Remove open parenthesis
-	s = strings.Replace(s, ")", "", -1)  // Remove close parenthesis
-	s = strings.Replace(s, "/", "", -1)  // Remove forward slashes
-	s = strings.Replace(s, "*", "", -1)  // Remove asterisks
-	s = strings.ToLower(s)
-	return s
+// dimensionCache runs the dimension queries of a scrape on first use.
+type dimensionCache struct {
+	ctx     context.Context
+	db      *sql.DB
+	results map[string]*dimensionResult
 }
 
-func main() {
-	log.AddFlags(kingpin.CommandLine)
-	kingpin.Version("dmdb_exporter " + Version)
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+type dimensionResult struct {
+	once      sync.Once
+	dimension Dimension
+	rows      map[string]map[string]string
+	err       error
+}
 
-	log.Infoln("Starting dmdb_exporter " + Version)
-	dsn := os.Getenv("DATA_SOURCE_NAME")
-	// Load default metrics
-	if _, err := toml.DecodeFile(*defaultFileMetrics, &metricsToScrap); err != nil {
-		log.Errorln(err)
-		panic(errors.New("Error while loading " + *defaultFileMetrics))
-	} else {
-		log.Infoln("Successfully loaded default metrics from: " + *defaultFileMetrics)
-	}
+// queryCache runs the shared queries of a scrape on first use.
+type queryCache struct {
+	ctx     context.Context
+	db      *sql.DB
+	results map[string]*queryResult
+}
 
-	// If custom metrics, load it
-	if strings.Compare(*customMetrics, "") != 0 {
-		if _, err := toml.DecodeFile(*customMetrics, &additionalMetrics); err != nil {
-			log.Errorln(err)
-			panic(errors.New("Error while loading " + *customMetrics))
-		} else {
-			log.Infoln("Successfully loaded custom metrics from: " + *customMetrics)
-		}
+// queryResult holds the rows of a shared query once it succeeded. A failed query is run again by
+// the next metric referencing it, e.g. after a timeout, rather than failing all of them.
+type queryResult struct {
+	mu    sync.Mutex
+	done  bool
+	query Query
+	rows  []map[string]string
+}
 
-		metricsToScrap.Metric = append(metricsToScrap.Metric, additionalMetrics.Metric...)
-	} else {
-		log.Infoln("No custom metrics defined.")
+// scrapeCounts counts the rows read and the series exported during a scrape.
+type scrapeCounts struct {
+	rows   int64
+	series int64
+}
+
+// Headroom of the suggested limits over the most series seen: 50% more, and at least 10 more.
+const (
+	cardinalityHeadroom    = 1.5
+	cardinalityMinHeadroom = 10
+)
+
+// Name of the state of the cardinality learning, saved at most every minute.
+const (
+	cardinalityState        = "cardinality"
+	cardinalitySaveInterval = time.Minute
+)
+
+// cardinalityLearner records the most series each metric exported in a scrape, to suggest
+// the limits of series per metric.
+type cardinalityLearner struct {
+	mu      sync.Mutex
+	started time.Time
+	scrapes int
+	max     map[string]int64
+	done    bool
+	store   *stateStore
+	saved   time.Time
+}
+
+// learnedCardinality is the saved state of a cardinalityLearner, so that a restart resumes the learning.
+type learnedCardinality struct {
+	Started time.Time        `json:"started"`
+	Scrapes int              `json:"scrapes"`
+	Max     map[string]int64 `json:"max"`
+}
+
+// newCardinalityLearner starts learning, or resumes the learning saved in store.
+func newCardinalityLearner(store *stateStore) *cardinalityLearner {
+	l := &cardinalityLearner{started: time.Now(), max: make(map[string]int64), store: store, saved: time.Now()}
+	var state learnedCardinality
+	if store.load(cardinalityState, &state) && state.Max != nil {
+		l.started, l.scrapes, l.max = state.Started, state.Scrapes, state.Max
+	}
+	return l
+}
+
+// observe records the series exported by a metric, identified by its limitKey.
+func (l *cardinalityLearner) observe(key string, series int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return
+	}
+	l.scrapes++
+	if max, ok := l.max[key]; !ok || series > max {
+		l.max[key] = series
+	}
+	if l.store != nil && time.Since(l.saved) >= cardinalitySaveInterval {
+		l.saved = time.Now()
+		if err := l.store.save(cardinalityState, learnedCardinality{l.started, l.scrapes, l.max}); err != nil {
+			log.Errorln("Error while saving the cardinality learning:", err)
+		}
+	}
+}
+
+// write stops learning and writes the suggested limits to path as TOML, read back by
+// --cardinality.enforce.
+func (l *cardinalityLearner) write(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done = true
+	keys := make([]string, 0, len(l.max))
+	for key := range l.max {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := "# Suggested limits of series per metric, learned from " + strconv.Itoa(l.scrapes) + " metric scrapes\n" +
+		"# between " + l.started.Format(time.RFC3339) + " and " + time.Now().Format(time.RFC3339) + ".\n" +
+		"[limits]\n"
+	for _, key := range keys {
+		limit := int64(math.Ceil(float64(l.max[key]) * cardinalityHeadroom))
+		if limit < l.max[key]+cardinalityMinHeadroom {
+			limit = l.max[key] + cardinalityMinHeadroom
+		}
+		out += strconv.Quote(key) + " = " + strconv.FormatInt(limit, 10) +
+			" # at most " + strconv.FormatInt(l.max[key], 10) + " seen\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(out), 0644); err != nil {
+		return err
+	}
+	return l.store.remove(cardinalityState)
+}
+
+// cardinalityLimitsFlag reads the limits of the limits file by limitKey with --cardinality.enforce.
+func cardinalityLimitsFlag() map[string]int64 {
+	if !*cardinalityEnforce {
+		return nil
+	}
+	limits := struct {
+		Limits map[string]int64 `json:"limits"`
+	}{}
+	if _, err := toml.DecodeFile(*cardinalityFile, &limits); err != nil {
+		panic(errors.New("Error while loading the cardinality limits " + *cardinalityFile + ": " + err.Error()))
+	}
+	return limits.Limits
+}
+
+// Metrics to scrap. Use external file (default-metrics.toml and custom if provided)
+// Once the exporter serves, they are only replaced by reloadMetrics, under metricsMu.
+var (
+	metricsMu      sync.RWMutex
+	metricsToScrap Metrics
+	metricsFiles   []string
+)
+
+// currentMetrics returns the loaded metrics and the files they were loaded from.
+func currentMetrics() (Metrics, []string) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return metricsToScrap, metricsFiles
+}
+
+// Outcome of the last reload of the metrics files, see --metrics.reload-interval.
+var (
+	reloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last reload of the metrics files succeeded.",
+	})
+	reloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time of the last successful load of the metrics files.",
+	})
+)
+
+// Values that could not be converted to float, counted instead of logged at every scrape.
+var (
+	parseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "parse_failures_total",
+		Help:      "Total number of values that could not be converted to float.",
+	}, []string{"context", "metric"})
+	truncatedScrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "truncated_scrapes_total",
+		Help:      "Total number of scrapes of a metric whose rows were truncated at maxrows.",
+	}, []string{"context"})
+	budgetExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "budget_exceeded_total",
+		Help:      "Total number of metrics failed as the scrape read more rows or bytes than its budget.",
+	}, []string{"context"})
+	droppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "series_dropped_total",
+		Help:      "Total number of series not exported as the metric exported more than its maxseries.",
+	}, []string{"context"})
+	duplicateSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "duplicate_series_total",
+		Help:      "Total number of series dropped as a series of the same name and labels was already exported by the scrape.",
+	}, []string{"name"})
+	queryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "query_retries_total",
+		Help:      "Total number of times the request of a metric was run again after an error, see retries.",
+	}, []string{"context"})
+	suppressedErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "suppressed_error_logs_total",
+		Help:      "Total number of errors of a metric not logged as the same error was logged less than --log.error-interval ago.",
+	}, []string{"context"})
+	errorLogMu        sync.Mutex
+	errorLogLast      = make(map[string]errorLog)
+	conversionLogMu   sync.Mutex
+	conversionLogLast = make(map[string]time.Time)
+	conversionSkipped = make(map[string]int)
+)
+
+// metricDefinition is the JSON representation of a loaded metric, along with
+// the fully-qualified names and types it produces and the timeout it runs with.
+type metricDefinition struct {
+	Metric
+	Names   map[string]string `json:"names"`
+	Timeout int               `json:"timeout"`
+}
+
+// contextState tracks the metrics of a context during one scrape, so that
+// metrics depending on it can wait for its outcome.
+type contextState struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	scraped int
+	failed  bool
+	totals  map[string]float64
+	// Time spent querying the metrics of the context
+	duration float64
+}
+
+// Time spent querying the metrics of each context during a scrape.
+var collectorDuration = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "collector_duration_seconds"),
+	"Time spent querying the metrics of the context during the scrape.", []string{"context"}, nil)
+
+// Whether the metrics of each context queried by a scrape were all queried without error,
+// including the errors of ignoreerrors unlike context_last_scrape_error.
+var collectorSuccess = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "collector_success"),
+	"Whether the metrics of the context were all queried without error during the scrape (1 for success, 0 for error).", []string{"context"}, nil)
+
+// Exporter collects DmService DB metrics. It implements prometheus.Collector.
+type Exporter struct {
+	// Guards dsn, otherDSN and db, swapped during a password rotation
+	connMu          sync.RWMutex
+	dsn             string
+	otherDSN        string
+	fallbackDSN     string
+	fallbackDB      *sql.DB
+	usingFallback   prometheus.Gauge
+	canaryUp        prometheus.Gauge
+	canaryDuration  prometheus.Gauge
+	canarySuccess   prometheus.Gauge
+	duration, error prometheus.Gauge
+	totalScrapes    prometheus.Counter
+	skippedScrapes  prometheus.Counter
+	queueWait       *prometheus.HistogramVec
+	scrapeTimeouts  prometheus.Counter
+	scrapeErrors    *prometheus.CounterVec
+	contextErrors   *prometheus.GaugeVec
+	contextSuccess  *prometheus.GaugeVec
+	up              prometheus.Gauge
+	inMaintenance   prometheus.Gauge
+	maintenance     *maintenance
+	limits          prometheus.Metric
+	invalidQueries  prometheus.Metric
+	learner         *cardinalityLearner
+	versionMu       sync.Mutex
+	versionDB       *sql.DB
+	version         string
+	db              *sql.DB
+	// Held during a scrape, so that scrapes of the target do not overlap
+	scraping *scrapeQueue
+	// Start of the scrape holding scraping in unixnano, 0 when none, for the systemd watchdog
+	scrapeStarted int64
+	lastMu        sync.Mutex
+	lastMetrics   []prometheus.Metric
+	// Last successful scrape of each metric of the slow tier
+	slowMu      sync.Mutex
+	slowResults map[string]*slowResult
+}
+
+// slowResult is the outcome of the last successful scrape of a metric of the slow tier.
+type slowResult struct {
+	scraped time.Time
+	metrics []prometheus.Metric
+	totals  map[string]float64
+}
+
+// slowKey identifies a metric of the slow tier across scrapes and reloads.
+func (m Metric) slowKey() string {
+	return m.Context + "\x00" + m.Request + "\x00" + m.QueryRef
+}
+
+// cachedSlow returns the last result of a metric of the slow tier, unless older than
+// --scrape.slow-interval.
+func (e *Exporter) cachedSlow(metric Metric) *slowResult {
+	e.slowMu.Lock()
+	defer e.slowMu.Unlock()
+	result, ok := e.slowResults[metric.slowKey()]
+	if !ok || time.Since(result.scraped) >= time.Duration(*slowInterval)*time.Second {
+		return nil
+	}
+	return result
+}
+
+func (e *Exporter) storeSlow(metric Metric, result *slowResult) {
+	e.slowMu.Lock()
+	defer e.slowMu.Unlock()
+	if e.slowResults == nil {
+		e.slowResults = make(map[string]*slowResult)
+	}
+	e.slowResults[metric.slowKey()] = result
+}
+
+// maintenance tells whether the target is in maintenance, either during one of the
+// configured windows or until the end set through the admin API.
+type maintenance struct {
+	mu      sync.Mutex
+	windows []timeWindow
+	until   time.Time
+	store   *stateStore
+}
+
+// Name of the state of the maintenance set through the admin API.
+const maintenanceState = "maintenance"
+
+// maintenanceUntil is the saved state of a maintenance.
+type maintenanceUntil struct {
+	Until time.Time `json:"until"`
+}
+
+// restore resumes the maintenance saved in its store, if it is not over yet.
+func (m *maintenance) restore() {
+	var state maintenanceUntil
+	if m.store.load(maintenanceState, &state) && time.Now().Before(state.Until) {
+		m.mu.Lock()
+		m.until = state.Until
+		m.mu.Unlock()
+		log.Infoln("Resuming the maintenance until", state.Until.Format(time.RFC3339))
+	}
+}
+
+// save saves the end of the maintenance set through the admin API, callers holding m.mu.
+func (m *maintenance) save() {
+	if err := m.store.save(maintenanceState, maintenanceUntil{m.until}); err != nil {
+		log.Errorln("Error while saving the maintenance:", err)
+	}
+}
+
+// active tells whether the target is in maintenance at t.
+func (m *maintenance) active(t time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.Before(m.until) {
+		return true
+	}
+	for _, window := range m.windows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler shows (GET), starts for the given duration (POST) or ends (DELETE) a maintenance.
+func (m *maintenance) handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		duration, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil || duration <= 0 {
+			http.Error(w, "Invalid duration \""+r.FormValue("duration")+"\", e.g. 30m or 2h.", http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.until = time.Now().Add(duration)
+		m.save()
+		m.mu.Unlock()
+		log.Infoln("Maintenance started for", duration)
+	case http.MethodDelete:
+		m.mu.Lock()
+		m.until = time.Time{}
+		m.save()
+		m.mu.Unlock()
+		log.Infoln("Maintenance ended")
+	default:
+		http.Error(w, "Method not allowed, use GET, POST or DELETE.", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	status := struct {
+		Active bool   `json:"active"`
+		Until  string `json:"until,omitempty"`
+	}{Active: m.active(now)}
+	m.mu.Lock()
+	if now.Before(m.until) {
+		status.Until = m.until.Format(time.RFC3339)
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorln("Error while encoding maintenance status:", err)
+	}
+}
+
+// targetStatus is the state of the last scrape of a target.
+type targetStatus struct {
+	Target     string  `json:"target"`
+	Up         bool    `json:"up"`
+	LastScrape string  `json:"last_scrape,omitempty"`
+	Duration   float64 `json:"duration_seconds"`
+	Error      string  `json:"error,omitempty"`
+	Scrapes    uint64  `json:"scrapes"`
+	Failures   uint64  `json:"failures"`
+}
+
+// Last state of the targets scraped by the exporter: its database and the instances
+// of the DataWatch pair, if any, in the order they were registered.
+var (
+	targetsMu     sync.Mutex
+	targets       = make(map[string]*targetStatus)
+	targetsOrder  []string
+	targetsTotal  = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "targets_total"), "Number of targets scraped by the exporter.", nil, nil)
+	targetsUp     = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "targets_up"), "Number of targets that were up at their last scrape.", nil, nil)
+	targetsFailed = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "targets_failed"), "Number of targets whose last scrape failed.", nil, nil)
+	// Per target, to find a single target failing among healthy ones
+	targetScrapes  = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "target_scrapes_total"), "Total number of scrapes of the target.", []string{"target"}, nil)
+	targetFailures = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "target_failures_total"), "Total number of failed scrapes of the target.", []string{"target"}, nil)
+	targetDuration = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "target_last_duration_seconds"), "Duration of the last scrape of the target.", []string{"target"}, nil)
+)
+
+// registerTarget adds a target, identified by its DSN, to the status of the exporter.
+func registerTarget(dsn string) {
+	target := maskDSN(dsn)
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	if _, ok := targets[target]; !ok {
+		targets[target] = &targetStatus{Target: target}
+		targetsOrder = append(targetsOrder, target)
+	}
+}
+
+// renameTarget keeps the status of a target when its DSN changes, e.g. to the other user
+// of a password rotation.
+func renameTarget(oldDSN, newDSN string) {
+	oldTarget, newTarget := maskDSN(oldDSN), maskDSN(newDSN)
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	status, ok := targets[oldTarget]
+	if _, exists := targets[newTarget]; !ok || exists {
+		return
+	}
+	delete(targets, oldTarget)
+	status.Target = newTarget
+	targets[newTarget] = status
+	for i := range targetsOrder {
+		if strings.Compare(targetsOrder[i], oldTarget) == 0 {
+			targetsOrder[i] = newTarget
+		}
+	}
+}
+
+// updateTarget records the result of the last scrape of a target.
+func updateTarget(dsn string, up bool, begun time.Time, err error) {
+	target := maskDSN(dsn)
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	status, ok := targets[target]
+	if !ok {
+		return
+	}
+	status.Up = up
+	status.LastScrape = begun.Format(time.RFC3339)
+	status.Duration = time.Since(begun).Seconds()
+	status.Error = ""
+	status.Scrapes++
+	if err != nil {
+		status.Error = err.Error()
+		status.Failures++
+	}
+}
+
+// collectTargets sends the number of targets, of targets up and of targets whose last scrape failed,
+// and the scrape statistics of each target.
+func collectTargets(ch chan<- prometheus.Metric) {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	up, failed := 0, 0
+	for _, status := range targets {
+		if status.Up {
+			up++
+		}
+		if strings.Compare(status.Error, "") != 0 {
+			failed++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(targetsTotal, prometheus.GaugeValue, float64(len(targets)))
+	ch <- prometheus.MustNewConstMetric(targetsUp, prometheus.GaugeValue, float64(up))
+	ch <- prometheus.MustNewConstMetric(targetsFailed, prometheus.GaugeValue, float64(failed))
+	for target, status := range targets {
+		ch <- prometheus.MustNewConstMetric(targetScrapes, prometheus.CounterValue, float64(status.Scrapes), target)
+		ch <- prometheus.MustNewConstMetric(targetFailures, prometheus.CounterValue, float64(status.Failures), target)
+		ch <- prometheus.MustNewConstMetric(targetDuration, prometheus.GaugeValue, status.Duration, target)
+	}
+}
+
+// Serve the last state of each target as JSON.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	targetsMu.Lock()
+	statuses := []targetStatus{}
+	for _, target := range targetsOrder {
+		statuses = append(statuses, *targets[target])
+	}
+	targetsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Targets []targetStatus `json:"targets"`
+	}{statuses}); err != nil {
+		log.Errorln("Error while encoding targets status:", err)
+	}
+}
+
+// Statements seen behind fingerprint labels, by fingerprint, up to maxSQLTexts of them.
+var (
+	sqlTextsMu sync.Mutex
+	sqlTexts   = make(map[string]string)
+)
+
+const maxSQLTexts = 10000
+
+// Parts of statements ignored by fingerprints: comments, literals and spacing.
+var (
+	sqlComment = regexp.MustCompile(`(?s)/\*.*?\*/|--[^\n]*`)
+	sqlString  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumber  = regexp.MustCompile(`\b[0-9]+(?:\.[0-9]+)?\b`)
+	sqlSpace   = regexp.MustCompile(`\s+`)
+)
+
+// sqlFingerprint returns a short hash of a statement that is the same whatever its literals,
+// comments, spacing and case, and records the statement to be looked up by it.
+func sqlFingerprint(statement string) string {
+	normalized := sqlComment.ReplaceAllString(statement, " ")
+	normalized = sqlString.ReplaceAllString(normalized, "?")
+	normalized = sqlNumber.ReplaceAllString(normalized, "?")
+	normalized = strings.ToUpper(strings.TrimSpace(sqlSpace.ReplaceAllString(normalized, " ")))
+	sum := sha256.Sum256([]byte(normalized))
+	fingerprint := hex.EncodeToString(sum[:8])
+	if *enableSQLLookup {
+		sqlTextsMu.Lock()
+		if _, ok := sqlTexts[fingerprint]; !ok && len(sqlTexts) < maxSQLTexts {
+			sqlTexts[fingerprint] = statement
+		}
+		sqlTextsMu.Unlock()
+	}
+	return fingerprint
+}
+
+// Serve the text of the statement seen with a fingerprint.
+func sqlHandler(w http.ResponseWriter, r *http.Request) {
+	sqlTextsMu.Lock()
+	statement, ok := sqlTexts[strings.TrimPrefix(r.URL.Path, sqlPath)]
+	sqlTextsMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(statement + "\n"))
+}
+
+// poolConnections returns the most connections a pool can open when running up to queries
+// at once for each scrape, or -1 when neither the pool nor the scrapes are limited.
+func poolConnections(queries int) int {
+	if *sequential {
+		return 1
+	}
+	concurrent := -1
+	if *maxRequests > 0 {
+		concurrent = queries * *maxRequests
+	}
+	if *maxOpenConns > 0 && (concurrent < 0 || *maxOpenConns < concurrent) {
+		return *maxOpenConns
+	}
+	return concurrent
+}
+
+// renamedMetric exports a metric under another name.
+type renamedMetric struct {
+	prometheus.Metric
+	desc *prometheus.Desc
+}
+
+func (m renamedMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// deprecatedMetrics lists the deprecated names set in aliases along with the metrics replacing them.
+func deprecatedMetrics() []prometheus.Metric {
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "deprecated_metric_info"),
+		"Deprecated metric name and the metric replacing it.",
+		[]string{"metric", "replacement"}, nil,
+	)
+	deprecations := []prometheus.Metric{}
+	metrics, _ := currentMetrics()
+	for _, metric := range metrics.Metric {
+		for column, alias := range metric.Aliases {
+			replacement := metric.fqName(column)
+			deprecations = append(deprecations, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, alias, replacement))
+		}
+	}
+	return deprecations
+}
+
+// connectionLimits logs the worst case of connections the exporter can open, warns when it
+// exceeds the budget, and returns it as an info metric.
+func connectionLimits(dataWatch bool) prometheus.Metric {
+	targets := 1
+	// Metrics of a scrape run at once, the DataWatch instances run one query each
+	queries := len(metricsToScrap.Metric)
+	if *maxConcurrency > 0 && *maxConcurrency < queries {
+		queries = *maxConcurrency
+	}
+	pools := []int{poolConnections(queries)}
+	if dataWatch {
+		targets += 2
+		pools = append(pools, poolConnections(1), poolConnections(1))
+	}
+	worstCase := 0
+	for _, connections := range pools {
+		if connections < 0 {
+			worstCase = -1
+			break
+		}
+		worstCase += connections
+	}
+	worstCaseValue := "unbounded"
+	if worstCase >= 0 {
+		worstCaseValue = strconv.Itoa(worstCase)
+	}
+	log.With("targets", targets).
+		With("max_open_conns", *maxOpenConns).
+		With("max_requests", *maxRequests).
+		With("metrics", len(metricsToScrap.Metric)).
+		With("worst_case_connections", worstCaseValue).
+		Infoln("Connection limits")
+	if *connectionBudget > 0 && (worstCase < 0 || worstCase > *connectionBudget) {
+		log.Warnln("The exporter could open", worstCaseValue, "connections, more than the budget of",
+			*connectionBudget, "- limit them with --database.maxOpenConns or --web.max-requests")
+	}
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "connection_limits_info"),
+		"Limits of the connections opened by the exporter, with the worst case of connections they allow.",
+		[]string{"targets", "max_open_conns", "max_requests", "worst_case_connections", "budget"}, nil)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, strconv.Itoa(targets),
+		strconv.Itoa(*maxOpenConns), strconv.Itoa(*maxRequests), worstCaseValue, strconv.Itoa(*connectionBudget))
+}
+
+// checkQueries prepares the requests and conditions of the metrics, dimensions and shared
+// queries, logging those the database rejects, and returns their number as a metric. It
+// returns nil when the database can not be reached.
+func checkQueries(db *sql.DB) prometheus.Metric {
+	if err := db.Ping(); err != nil {
+		log.Errorln("Unable to validate the queries, the database can not be reached:", err)
+		return nil
+	}
+	requests := [][2]string{}
+	for _, metric := range metricsToScrap.Metric {
+		for _, request := range []string{metric.Request, metric.Condition} {
+			if strings.Compare(request, "") != 0 {
+				requests = append(requests, [2]string{metric.Context, request})
+			}
+		}
+	}
+	for _, dimension := range metricsToScrap.Dimension {
+		requests = append(requests, [2]string{"dimension " + dimension.Name, dimension.Request})
+	}
+	for _, query := range metricsToScrap.Query {
+		requests = append(requests, [2]string{"query " + query.Name, query.Request})
+	}
+	invalid := 0
+	for _, request := range requests {
+		ctx, cancel := queryContext(context.Background())
+		stmt, err := db.PrepareContext(ctx, request[1])
+		cancel()
+		if err != nil {
+			invalid++
+			log.Errorln("Invalid request of", request[0], ":", err)
+			recordError(request[0], err)
+			continue
+		}
+		stmt.Close()
+	}
+	log.Infoln("Validated", len(requests), "requests,", invalid, "invalid")
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "invalid_queries"),
+		"Number of requests rejected by the database when validated at startup.", nil, nil)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(invalid))
+}
+
+// hasLabel tells whether name is one of labels.
+func hasLabel(labels []string, name string) bool {
+	for _, label := range labels {
+		if strings.Compare(label, name) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceRoleKey is the context key of the role of the fallback database a scrape goes through,
+// added as role label to the samples.
+type sourceRoleKey struct{}
+
+// maintenanceKey is the context key telling that a scrape runs during a maintenance.
+type maintenanceKey struct{}
+
+// inMaintenance tells whether the scrape running with ctx runs during a maintenance.
+func inMaintenance(ctx context.Context) bool {
+	active, _ := ctx.Value(maintenanceKey{}).(bool)
+	return active
+}
+
+// maintenanceLogger logs errors and warnings at debug level during a maintenance.
+type maintenanceLogger struct {
+	log.Logger
+}
+
+func (l maintenanceLogger) Warn(args ...interface{})                  { l.Debug(args...) }
+func (l maintenanceLogger) Warnln(args ...interface{})                { l.Debugln(args...) }
+func (l maintenanceLogger) Warnf(format string, args ...interface{})  { l.Debugf(format, args...) }
+func (l maintenanceLogger) Error(args ...interface{})                 { l.Debug(args...) }
+func (l maintenanceLogger) Errorln(args ...interface{})               { l.Debugln(args...) }
+func (l maintenanceLogger) Errorf(format string, args ...interface{}) { l.Debugf(format, args...) }
+
+// moduleKey is the context key of the module, i.e. metrics file, a scrape is restricted to.
+type moduleKey struct{}
+
+// moduleName returns the module of the metrics loaded from file: its name without extension.
+func moduleName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// collectKey is the context key of the groups a scrape is restricted to, set with collect[].
+type collectKey struct{}
+
+// requestIDKey is the context key of the ID of the request a scrape runs for.
+type requestIDKey struct{}
+
+// Header carrying the ID of a request, taken from the request when set and sent back in the response.
+const requestIDHeader = "X-Request-Id"
+
+// newRequestID returns a random ID for a request that came without one.
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestLogger returns a logger adding the ID of the request in ctx, if any, to each line,
+// and only logging errors at debug level during a maintenance.
+func requestLogger(ctx context.Context) log.Logger {
+	logger := log.Base()
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		logger = log.With("request_id", id)
+	}
+	if inMaintenance(ctx) {
+		logger = maintenanceLogger{logger}
+	}
+	return logger
+}
+
+// maskDSN hides the password of a DSN so that it can be logged. The DSN is not parsed as a
+// URL: a password with a #, / or % fails to parse or ends up in the host. Everything between
+// the user and the last @ is dropped instead, also for DSNs without scheme such as user/password@host.
+func maskDSN(dsn string) string {
+	start := strings.Index(dsn, "//") + 2
+	separators := ":"
+	if start < 2 {
+		start, separators = 0, ":/"
+	}
+	at := strings.LastIndex(dsn, "@")
+	if at < start {
+		return dsn
+	}
+	user := dsn[start:at]
+	if end := strings.IndexAny(user, separators); end >= 0 {
+		user = user[:end]
+	}
+	return dsn[:start] + user + dsn[at:]
+}
+
+// getEnv returns the value of an environment variable, or returns the provided fallback value
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+
+
+// withDSNParam adds a parameter to a DSN, unless the DSN already sets it.
+func withDSNParam(dsn string, key string, value string) string {
+	if strings.Contains(dsn, key+"=") {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + key + "=" + url.QueryEscape(value)
+}
+
+func connect(dsn string) *sql.DB {
+	// Tag the sessions of the exporter so that they can be told apart in V$SESSIONS
+	if strings.Compare(*appName, "") != 0 {
+		dsn = withDSNParam(dsn, "appName", *appName)
+	}
+	dsn = withDSNParam(dsn, "autoCommit", strconv.FormatBool(*autoCommit))
+	log.Debugln("Launching connection: ", maskDSN(dsn))
+
+	//db, err := sql.Open("dm", "dm://SYSDBA:SYSDBA@172.20.58.135:5236?autoCommit=true")
+	db, err := sql.Open("dm", dsn)
+
+	if err != nil {
+		log.Errorln("Error while connecting to", maskDSN(dsn))
+		panic(err)
+	}
+	log.Debugln("set max idle connections to ", *maxIdleConns)
+	db.SetMaxIdleConns(*maxIdleConns)
+	log.Debugln("set max open connections to ", *maxOpenConns)
+	db.SetMaxOpenConns(*maxOpenConns)
+	if *sequential {
+		// Scrapes, even concurrent ones, then wait for each other on the single connection
+		db.SetMaxIdleConns(1)
+		db.SetMaxOpenConns(1)
+	}
+	log.Debugln("Successfully connected to: ", maskDSN(dsn))
+	return db
+}
+
+// NewExporter returns a new DmService DB exporter for the provided DSN.
+func NewExporter(dsn string) *Exporter {
+	db := connect(dsn)
+	return &Exporter{
+		dsn: dsn,
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "last_scrape_duration_seconds",
+			Help:      "Duration of the last scrape of metrics from DM DB.",
+		}),
+		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrapes_total",
+			Help:      "Total number of times DM DB was scraped for metrics.",
+		}),
+		skippedScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrapes_skipped_total",
+			Help:      "Total number of scrapes not run as the previous one was still running.",
+		}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_queue_wait_seconds",
+			Help:      "Time scrapes waited for their turn on the target, by module when scraping a module path.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+		}, []string{"target", "module"}),
+		scrapeTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_timeout_total",
+			Help:      "Total number of scrapes that lasted more than --scrape.timeout.",
+		}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_errors_total",
+			Help:      "Total number of times an error occured scraping a DM database, by DM error code and class of error.",
+		}, []string{"collector", "code", "class"}),
+		contextErrors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "context_last_scrape_error",
+			Help:      "Whether a metric of the context failed in the last scrape it was part of (1 for error, 0 for success).",
+		}, []string{"context"}),
+		contextSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "collector_last_success_timestamp_seconds",
+			Help:      "Time the metrics of the context were last queried without error, in unixtime.",
+		}, []string{"context"}),
+		error: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "last_scrape_error",
+			Help:      "Whether the last scrape of metrics from DM DB resulted in an error (1 for error, 0 for success).",
+		}),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "up",
+			Help:      "Whether the DM database server is up.",
+		}),
+		inMaintenance: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "maintenance",
+			Help:      "Whether the DM database is in maintenance, errors being neither counted nor logged (1 for maintenance, 0 otherwise).",
+		}),
+		usingFallback: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "fallback",
+			Help:      "Whether the last scrape went through the fallback database as the database was down (1 for fallback, 0 otherwise).",
+		}),
+		canaryUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "canary_up",
+			Help:      "Whether the canary query of the last scrape succeeded.",
+		}),
+		canaryDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "canary_duration_seconds",
+			Help:      "Duration of the canary query of the last scrape.",
+		}),
+		canarySuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "canary_last_success_timestamp_seconds",
+			Help:      "Time the canary query last succeeded, to alert when it gets old.",
+		}),
+		maintenance: &maintenance{},
+		db:          db,
+		scraping:    newScrapeQueue(),
+	}
+}
+
+// runCanary runs the canary query, whose success tells that the SQL path works
+// independently of the metrics.
+func (e *Exporter) runCanary(ctx context.Context, db *sql.DB, logger log.Logger) {
+	if strings.Compare(*canaryQuery, "") == 0 {
+		return
+	}
+	begun := time.Now()
+	err := GeneratePrometheusMetrics(ctx, db, func(row map[string]string) error { return nil }, *canaryQuery)
+	e.canaryDuration.Set(time.Since(begun).Seconds())
+	if err != nil {
+		logger.Errorln("Error running the canary query:", err)
+		recordError("canary", err)
+		e.canaryUp.Set(0)
+		return
+	}
+	e.canaryUp.Set(1)
+	e.canarySuccess.Set(float64(begun.UnixNano()) / float64(time.Second))
+}
+
+// switchCredentials connects with the other credentials of the database, when the ones
+// in use stop working during a password rotation.
+func (e *Exporter) switchCredentials(ctx context.Context, logger log.Logger) error {
+	db := connect(e.otherDSN)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return err
+	}
+	logger.Infoln("Switched to the other credentials of", maskDSN(e.otherDSN))
+	e.connMu.Lock()
+	previous := e.db
+	e.db = db
+	e.dsn, e.otherDSN = e.otherDSN, e.dsn
+	e.connMu.Unlock()
+	renameTarget(e.otherDSN, e.dsn)
+	closeStatements(previous)
+	previous.Close()
+	return nil
+}
+
+// target is the DSN in use, password masked, identifying the database in the metrics.
+func (e *Exporter) target() string {
+	_, dsn := e.conn()
+	return maskDSN(dsn)
+}
+
+// conn returns the connection pool of the database and the DSN it uses.
+func (e *Exporter) conn() (*sql.DB, string) {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+	return e.db, e.dsn
+}
+
+// Describe implements prometheus.Collector. It describes nothing, making the exporter an
+// unchecked collector: its metrics are only known by querying the database, which must not
+// happen when registering it.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(context.Background(), ch)
+}
+
+// collect scrapes the database with queries bound to ctx.
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.scrapeAlone(ctx, ch)
+	ch <- e.duration
+	ch <- e.totalScrapes
+	ch <- e.skippedScrapes
+	e.queueWait.Collect(ch)
+	ch <- e.scrapeTimeouts
+	ch <- e.error
+	e.scrapeErrors.Collect(ch)
+	e.contextErrors.Collect(ch)
+	e.contextSuccess.Collect(ch)
+	parseFailures.Collect(ch)
+	truncatedScrapes.Collect(ch)
+	budgetExceeded.Collect(ch)
+	droppedSeries.Collect(ch)
+	duplicateSeries.Collect(ch)
+	queryRetries.Collect(ch)
+	suppressedErrors.Collect(ch)
+	collectQueryStats(ch)
+	ch <- e.up
+	ch <- e.inMaintenance
+	ch <- e.usingFallback
+	if strings.Compare(*canaryQuery, "") != 0 {
+		ch <- e.canaryUp
+		ch <- e.canaryDuration
+		ch <- e.canarySuccess
+	}
+	if e.limits != nil {
+		ch <- e.limits
+	}
+	if e.invalidQueries != nil {
+		ch <- e.invalidQueries
+	}
+	if *reloadInterval > 0 {
+		ch <- reloadSuccessful
+		ch <- reloadSuccessTime
+	}
+	for _, deprecation := range deprecatedMetrics() {
+		ch <- deprecation
+	}
+	collectTargets(ch)
+}
+
+// scrapeQueue lets one scrape of a target run at a time. The waiting scrapes are queued by
+// module, the full scrapes being a module of their own, and the modules take turns, so that
+// the scrapes of a module with many metrics delay those of another one by one scrape at most.
+type scrapeQueue struct {
+	mu      sync.Mutex
+	busy    bool
+	waiting map[string][]chan struct{}
+	// Modules with waiting scrapes, in the order of their turns
+	turns []string
+}
+
+func newScrapeQueue() *scrapeQueue {
+	return &scrapeQueue{waiting: make(map[string][]chan struct{})}
+}
+
+// tryAcquire takes the target if no scrape is running.
+func (q *scrapeQueue) tryAcquire() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.busy {
+		return false
+	}
+	q.busy = true
+	return true
+}
+
+// acquire waits for the turn of a scrape of module, or gives up once ctx is done.
+func (q *scrapeQueue) acquire(ctx context.Context, module string) error {
+	q.mu.Lock()
+	if !q.busy {
+		q.busy = true
+		q.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	if len(q.waiting[module]) == 0 {
+		q.turns = append(q.turns, module)
+	}
+	q.waiting[module] = append(q.waiting[module], turn)
+	q.mu.Unlock()
+
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-turn:
+		// Handed the target while giving up, pass it on
+		q.next()
+		return ctx.Err()
+	default:
+	}
+	waiting := q.waiting[module]
+	for i := range waiting {
+		if waiting[i] == turn {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	q.waiting[module] = waiting
+	if len(waiting) == 0 {
+		delete(q.waiting, module)
+		for i := range q.turns {
+			if strings.Compare(q.turns[i], module) == 0 {
+				q.turns = append(q.turns[:i], q.turns[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// release hands the target over to the next scrape.
+func (q *scrapeQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next()
+}
+
+// next hands the target over to the first scrape of the module whose turn it is, which then
+// waits behind the other modules for its next scrape. Called with mu held.
+func (q *scrapeQueue) next() {
+	if len(q.turns) == 0 {
+		q.busy = false
+		return
+	}
+	module := q.turns[0]
+	q.turns = q.turns[1:]
+	waiting := q.waiting[module]
+	close(waiting[0])
+	if len(waiting) > 1 {
+		q.waiting[module] = waiting[1:]
+		q.turns = append(q.turns, module)
+	} else {
+		delete(q.waiting, module)
+	}
+}
+
+// scrapeAlone scrapes the database unless a scrape of the target is still running. It then
+// waits for its turn or, with --scrape.overlap=skip, serves the metrics of the last full scrape.
+func (e *Exporter) scrapeAlone(ctx context.Context, ch chan<- prometheus.Metric) {
+	logger := requestLogger(ctx)
+	module, _ := ctx.Value(moduleKey{}).(string)
+	queued := time.Now()
+	if !e.scraping.tryAcquire() {
+		if *scrapeOverlap == "skip" {
+			logger.Warnln("Previous scrape still running, serving its last metrics")
+			e.skippedScrapes.Inc()
+			e.lastMu.Lock()
+			last := e.lastMetrics
+			e.lastMu.Unlock()
+			for _, metric := range last {
+				ch <- metric
+			}
+			return
+		}
+		logger.Debugln("Waiting for the previous scrape")
+		if err := e.scraping.acquire(ctx, module); err != nil {
+			logger.Warnln("Previous scrape still running, giving up:", err)
+			e.queueWait.WithLabelValues(e.target(), module).Observe(time.Since(queued).Seconds())
+			e.skippedScrapes.Inc()
+			return
+		}
+	}
+	e.queueWait.WithLabelValues(e.target(), module).Observe(time.Since(queued).Seconds())
+	atomic.StoreInt64(&e.scrapeStarted, time.Now().UnixNano())
+	defer func() {
+		atomic.StoreInt64(&e.scrapeStarted, 0)
+		e.scraping.release()
+	}()
+
+	_, groups := ctx.Value(collectKey{}).(map[string]bool)
+	if *scrapeOverlap != "skip" || strings.Compare(module, "") != 0 || groups {
+		e.scrape(ctx, ch)
+		return
+	}
+	// Keep the metrics of the full scrapes for the skipped ones
+	scraped := []prometheus.Metric{}
+	tee := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for metric := range tee {
+			scraped = append(scraped, metric)
+			ch <- metric
+		}
+		close(done)
+	}()
+	e.scrape(ctx, tee)
+	close(tee)
+	<-done
+	e.lastMu.Lock()
+	e.lastMetrics = scraped
+	e.lastMu.Unlock()
+}
+
+func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.totalScrapes.Inc()
+	if e.maintenance.active(time.Now()) {
+		ctx = context.WithValue(ctx, maintenanceKey{}, true)
+		e.inMaintenance.Set(1)
+	} else {
+		e.inMaintenance.Set(0)
+	}
+	logger := requestLogger(ctx)
+	ch, flush := uniqueSeries(ch, logger)
+	defer flush()
+	if *prepareQueries {
+		prepared := acquireStatements()
+		defer prepared.release()
+		ctx = context.WithValue(ctx, statementsKey{}, prepared)
+	}
+	if *scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*scrapeTimeout)*time.Second)
+		defer cancel()
+	}
+	var err error
+	up := false
+	states := make(map[string]*contextState)
+	counts := &scrapeCounts{}
+	defer func(begun time.Time) {
+		duration := time.Since(begun).Seconds()
+		e.duration.Set(duration)
+		if err == nil {
+			e.error.Set(0)
+		} else {
+			e.error.Set(1)
+		}
+		_, dsn := e.conn()
+		updateTarget(dsn, up, begun, err)
+		contextsOK, contextsFailed := 0, 0
+		for _, state := range states {
+			if state.failed {
+				contextsFailed++
+			} else if state.scraped > 0 {
+				contextsOK++
+			}
+		}
+		logger.With("target", maskDSN(dsn)).
+			With("duration_seconds", duration).
+			With("contexts_ok", contextsOK).
+			With("contexts_failed", contextsFailed).
+			With("rows", atomic.LoadInt64(&counts.rows)).
+			With("series", atomic.LoadInt64(&counts.series)).
+			Infoln("Scrape finished")
+	}(time.Now())
+
+	db, dsn := e.conn()
+	if err = db.PingContext(ctx); err != nil {
+		if strings.Contains(err.Error(), "sql: database is closed") {
+			logger.Infoln("Reconnecting to DB")
+			closeStatements(db)
+			db = connect(dsn)
+			e.connMu.Lock()
+			e.db = db
+			e.connMu.Unlock()
+		}
+	}
+	if err = db.PingContext(ctx); err != nil && strings.Compare(e.otherDSN, "") != 0 {
+		err = e.switchCredentials(ctx, logger)
+	}
+	db, _ = e.conn()
+	e.usingFallback.Set(0)
+	if err != nil {
+		logger.Errorln("Error pinging dm db:", err)
+		recordError("up", err)
+		e.canaryUp.Set(0)
+		//e.db.Close()
+		e.up.Set(0)
+		if e.fallbackDB == nil {
+			return
+		}
+		// Keep the metrics visible through the fallback, e.g. the standby during an outage of the primary
+		if fallbackErr := e.fallbackDB.PingContext(ctx); fallbackErr != nil {
+			logger.Errorln("Error pinging fallback dm db:", fallbackErr)
+			return
+		}
+		logger.Infoln("Scraping through the fallback database", maskDSN(e.fallbackDSN))
+		db = e.fallbackDB
+		e.usingFallback.Set(1)
+	} else {
+		logger.Debugln("Successfully pinged DM database: ")
+		e.up.Set(1)
+		up = true
+	}
+
+	// Checked first, so that it does not wait behind the metrics for a connection
+	e.runCanary(ctx, db, logger)
+
+	// The role is only queried when a metric is restricted to one, or to label the metrics of the fallback
+	metrics, _ := currentMetrics()
+	var role string
+	var roleErr error
+	if db == e.fallbackDB || restrictsRole(metrics.Metric) {
+		role, roleErr = getInstanceRole(ctx, db)
+		logRoleError(logger, roleErr)
+		if roleErr == nil {
+			logger.Debugln("Instance role is: ", role)
+		}
+	}
+	if db == e.fallbackDB {
+		source := role
+		if roleErr != nil {
+			source = roleStandby
+		}
+		ctx = context.WithValue(ctx, sourceRoleKey{}, source)
+	}
+
+	version, versionErr := e.getVersion(ctx, db)
+	if versionErr != nil {
+		logger.Errorln("Error while getting DM version, only metrics without version range will be scraped:", versionErr)
+	}
+
+	wg := sync.WaitGroup{}
+	toScrap := []Metric{}
+	if *scrapeMaxRows > 0 || *scrapeMaxBytes > 0 {
+		ctx = context.WithValue(ctx, budgetKey{}, &scrapeBudget{})
+	}
+	dimensions := newDimensionCache(ctx, db, metrics.Dimension)
+	queries := newQueryCache(ctx, db, metrics.Query)
+	now := time.Now()
+
+	module, _ := ctx.Value(moduleKey{}).(string)
+	collected, _ := ctx.Value(collectKey{}).(map[string]bool)
+	if strings.Compare(module, "") == 0 && collected == nil {
+		scrapeParameters(ctx, db, ch, logger)
+	}
+	for _, metric := range metrics.Metric {
+		if strings.Compare(module, "") != 0 && strings.Compare(metric.module, module) != 0 {
+			continue
+		}
+		if collected != nil && !collected[metric.Group] {
+			continue
+		}
+		if metric.Role != "" && !strings.EqualFold(metric.Role, roleAny) && !strings.EqualFold(metric.Role, role) {
+			logger.Debugln("Skipping metric ", metric.Context, " restricted to role ", metric.Role)
+			continue
+		}
+		if strings.Compare(metric.MinVersion+metric.MaxVersion, "") != 0 && (versionErr != nil || !metric.inVersions(version)) {
+			logger.Debugln("Skipping metric ", metric.Context, " not applying to version ", version)
+			continue
+		}
+		if !metric.inSchedule(now) {
+			logger.Debugln("Skipping metric ", metric.Context, " outside of its schedule")
+			continue
+		}
+		state, ok := states[metric.Context]
+		if !ok {
+			state = &contextState{totals: make(map[string]float64)}
+			states[metric.Context] = state
+		}
+		state.wg.Add(1)
+		toScrap = append(toScrap, metric)
+	}
+
+	// scrapeMetric returns the error of a metric, unless ignored with ignoreerrors
+	scrapeMetric := func(metric Metric) (metricErr error) {
+		state := states[metric.Context]
+		defer state.wg.Done()
+		// A bug parsing the rows of a metric fails that metric, not the exporter
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr := fmt.Errorf("panic: %v", r)
+				metricErr = panicErr
+				logger.Errorln("Panic scraping for", metric.Context, ":", r, "\n", string(debug.Stack()))
+				recordError(metric.Context, panicErr)
+				if !inMaintenance(ctx) {
+					e.scrapeErrors.WithLabelValues(append([]string{metric.Context}, classifyError(panicErr)...)...).Inc()
+					scrapeFailed(ch, metric.Context, panicErr)
+				}
+				state.mu.Lock()
+				state.failed = true
+				state.mu.Unlock()
+			}
+		}()
+
+		if len(metric.Request) == 0 && len(metric.QueryRef) == 0 {
+			logger.Errorln("Error scraping for ", metric.MetricsDesc, ". Did you forget to define request in your toml file?")
+		}
+
+		if len(metric.MetricsDesc) == 0 {
+			logger.Errorln("Error scraping for query", metric.Request, ". Did you forget to define metricsdesc  in your toml file?")
+		}
+
+		if metric.DependsOn != nil && !dependencySatisfied(metric.DependsOn, states[metric.DependsOn.Context]) {
+			logger.Debugln("Skipping metric ", metric.Context, ", dependency on ", metric.DependsOn.Context, " not satisfied")
+			return nil
+		}
+
+		slow := strings.EqualFold(metric.Tier, tierSlow)
+		if slow {
+			if cached := e.cachedSlow(metric); cached != nil {
+				logger.Debugln("Serving metric ", metric.Context, " of the slow tier queried at ", cached.scraped)
+				for _, m := range cached.metrics {
+					ch <- m
+				}
+				state.mu.Lock()
+				state.scraped++
+				for name, value := range cached.totals {
+					state.totals[name] += value
+				}
+				state.mu.Unlock()
+				return nil
+			}
+		}
+
+		if len(metric.Condition) != 0 {
+			run, condErr := evaluateCondition(ctx, db, metric.Condition)
+			if condErr != nil && metric.IgnoreErrors {
+				logger.Debugln("Ignoring error evaluating condition for", metric.Context, ":", condErr)
+				state.mu.Lock()
+				state.failed = true
+				state.mu.Unlock()
+				return nil
+			}
+			if condErr != nil {
+				logger.Errorln("Error evaluating condition for", metric.Context, ":", condErr)
+				recordError(metric.Context, condErr)
+				if !inMaintenance(ctx) {
+					e.scrapeErrors.WithLabelValues(append([]string{metric.Context}, classifyError(condErr)...)...).Inc()
+					scrapeFailed(ch, metric.Context, condErr)
+				}
+				state.mu.Lock()
+				state.failed = true
+				state.mu.Unlock()
+				return condErr
+			}
+			if !run {
+				logger.Debugln("Skipping metric ", metric.Context, ", condition is false")
+				return nil
+			}
+		}
+
+		begun := time.Now()
+		var totals map[string]float64
+		var metricCounts *scrapeCounts
+		var scrapeErr error
+		if slow {
+			// Kept for the next scrapes when successful
+			scraped := []prometheus.Metric{}
+			record := make(chan prometheus.Metric)
+			done := make(chan struct{})
+			go func() {
+				for m := range record {
+					scraped = append(scraped, m)
+					ch <- m
+				}
+				close(done)
+			}()
+			func() {
+				defer close(record)
+				totals, metricCounts, scrapeErr = scrapeWithRetries(ctx, db, record, metric, dimensions, queries, logger)
+			}()
+			<-done
+			if scrapeErr == nil {
+				e.storeSlow(metric, &slowResult{scraped: begun, metrics: scraped, totals: totals})
+			}
+		} else {
+			totals, metricCounts, scrapeErr = scrapeWithRetries(ctx, db, ch, metric, dimensions, queries, logger)
+		}
+		duration := time.Since(begun).Seconds()
+		atomic.AddInt64(&counts.rows, metricCounts.rows)
+		atomic.AddInt64(&counts.series, metricCounts.series)
+		if e.learner != nil && scrapeErr == nil {
+			e.learner.observe(metric.limitKey(), metricCounts.series)
+		}
+		state.mu.Lock()
+		state.scraped++
+		state.duration += duration
+		if scrapeErr != nil {
+			state.failed = true
+		}
+		for name, value := range totals {
+			state.totals[name] += value
+		}
+		state.mu.Unlock()
+		if scrapeErr != nil && metric.IgnoreErrors {
+			logger.Debugln("Ignoring error scraping for", metric.Context, ":", scrapeErr)
+			return nil
+		}
+		logScrapeError(logger, metric, scrapeErr)
+		if scrapeErr != nil {
+			recordError(metric.Context, scrapeErr)
+			if !inMaintenance(ctx) {
+				e.scrapeErrors.WithLabelValues(append([]string{metric.Context}, classifyError(scrapeErr)...)...).Inc()
+				scrapeFailed(ch, metric.Context, scrapeErr)
+			}
+		}
+		return scrapeErr
+	}
+
+	// The metrics are handed to the workers with their dependencies first, so that a worker
+	// waiting for a dependency never waits for a metric still queued behind it.
+	toScrap = dependencyOrder(toScrap)
+	workers := len(toScrap)
+	if *maxConcurrency > 0 && *maxConcurrency < workers {
+		workers = *maxConcurrency
+	}
+	if *sequential && workers > 1 {
+		workers = 1
+	}
+	// Each worker writes the results of its own metrics, read once all of them are done
+	results := make([]error, len(toScrap))
+	queue := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = scrapeMetric(toScrap[i])
+			}
+		}()
+	}
+	for i := range toScrap {
+		select {
+		case queue <- i:
+			continue
+		case <-ctx.Done():
+		}
+		// Out of time, the metrics left are not queried
+		for _, skipped := range toScrap[i:] {
+			states[skipped.Context].wg.Done()
+		}
+		for j := i; j < len(toScrap); j++ {
+			results[j] = errScrapeTimeout
+		}
+		break
+	}
+	close(queue)
+	wg.Wait()
+	if *scrapeTimeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		logger.Warnln("Scrape lasted more than", *scrapeTimeout, "seconds, the metrics not queried yet were skipped")
+		e.scrapeTimeouts.Inc()
+	}
+
+	contextFailed := make(map[string]bool)
+	for i, metricErr := range results {
+		contextFailed[toScrap[i].Context] = contextFailed[toScrap[i].Context] || metricErr != nil
+		// The scrape fails with the first error, in the order of the metrics
+		if metricErr != nil && err == nil {
+			err = metricErr
+		}
+	}
+	for context, failed := range contextFailed {
+		if failed {
+			e.contextErrors.WithLabelValues(context).Set(1)
+		} else {
+			e.contextErrors.WithLabelValues(context).Set(0)
+		}
+		state := states[context]
+		// Also failed on the errors of ignoreerrors, which are not counted as errors, and
+		// only for the contexts queried: skipped on a condition or dependency tells nothing
+		if failed || state.failed {
+			ch <- prometheus.MustNewConstMetric(collectorSuccess, prometheus.GaugeValue, 0, context)
+		} else if state.scraped > 0 {
+			ch <- prometheus.MustNewConstMetric(collectorSuccess, prometheus.GaugeValue, 1, context)
+		}
+		if state.scraped > 0 {
+			ch <- prometheus.MustNewConstMetric(collectorDuration, prometheus.GaugeValue, state.duration, context)
+			if !failed && !state.failed {
+				e.contextSuccess.WithLabelValues(context).SetToCurrentTime()
+			}
+		}
+	}
+}
+
+// dependencyOrder sorts the metrics so that the metrics of a context come after those of the
+// contexts it depends on, then the critical metrics first, keeping the order of the metrics
+// files otherwise.
+func dependencyOrder(metrics []Metric) []Metric {
+	dependencies := make(map[string][]string)
+	for _, metric := range metrics {
+		if metric.DependsOn != nil {
+			dependencies[metric.Context] = append(dependencies[metric.Context], metric.DependsOn.Context)
+		}
+	}
+	// checkDependencies made sure there is no cycle
+	depths := make(map[string]int)
+	var depth func(context string) int
+	depth = func(context string) int {
+		if d, ok := depths[context]; ok {
+			return d
+		}
+		d := 0
+		for _, dependency := range dependencies[context] {
+			if dd := depth(dependency) + 1; dd > d {
+				d = dd
+			}
+		}
+		depths[context] = d
+		return d
+	}
+	sorted := append([]Metric{}, metrics...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if depthI, depthJ := depth(sorted[i].Context), depth(sorted[j].Context); depthI != depthJ {
+			return depthI < depthJ
+		}
+		return strings.EqualFold(sorted[i].Tier, tierCritical) && !strings.EqualFold(sorted[j].Tier, tierCritical)
+	})
+	return sorted
+}
+
+// Delay before the first retry of a metric without retrydelay, doubled at each retry.
+const defaultRetryDelay = time.Second
+
+// scrapeWithRetries scrapes a metric, running it again up to retries times on errors. The
+// metrics of a failed attempt are dropped, except those of the last one.
+func scrapeWithRetries(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, metric Metric,
+	dimensions *dimensionCache, queries *queryCache, logger log.Logger) (map[string]float64, *scrapeCounts, error) {
+	delay := metric.retryDelay
+	for attempt := int64(0); ; attempt++ {
+		totals := make(map[string]float64)
+		counts := &scrapeCounts{}
+		if attempt >= metric.Retries {
+			return totals, counts, ScrapeMetric(ctx, db, ch, metric, dimensions, queries, totals, counts)
+		}
+		scraped := []prometheus.Metric{}
+		buffer := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for m := range buffer {
+				scraped = append(scraped, m)
+			}
+			close(done)
+		}()
+		err := func() error {
+			// Also stops the goroutine above when the scrape panics
+			defer close(buffer)
+			return ScrapeMetric(ctx, db, buffer, metric, dimensions, queries, totals, counts)
+		}()
+		<-done
+		if err == nil || err == errOverBudget || ctx.Err() != nil {
+			for _, m := range scraped {
+				ch <- m
+			}
+			return totals, counts, err
+		}
+		if metric.IgnoreErrors {
+			logger.Debugln("Error scraping for", metric.Context, "- retrying in", delay.String()+":", err)
+		} else {
+			logger.Warnln("Error scraping for", metric.Context, "- retrying in", delay.String()+":", err)
+		}
+		queryRetries.WithLabelValues(metric.Context).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return totals, counts, err
+		}
+		delay *= 2
+	}
+}
+
+// Name of a metric in the description of its Desc, which has no accessor for it.
+var descName = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// uniqueSeries forwards the metrics sent to the returned channel to ch, dropping the series
+// already sent, e.g. two rows with the same labels or two fieldtoappend values cleaned to the
+// same name: the registry would otherwise fail the whole scrape. flush must be called once
+// nothing more is sent.
+func uniqueSeries(ch chan<- prometheus.Metric, logger log.Logger) (chan<- prometheus.Metric, func()) {
+	unique := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		seen := make(map[string]bool)
+		duplicates := make(map[string]int)
+		for metric := range unique {
+			var series dto.Metric
+			match := descName.FindStringSubmatch(metric.Desc().String())
+			// Invalid metrics report errors, always sent
+			if err := metric.Write(&series); err != nil || match == nil {
+				ch <- metric
+				continue
+			}
+			key := match[1]
+			for _, label := range series.Label {
+				key += "\xff" + label.GetName() + "\xff" + label.GetValue()
+			}
+			if seen[key] {
+				duplicates[match[1]]++
+				continue
+			}
+			seen[key] = true
+			ch <- metric
+		}
+		for name, count := range duplicates {
+			logger.Warnln("Dropped", count, "duplicate series of metric", name)
+			duplicateSeries.WithLabelValues(name).Add(float64(count))
+		}
+		close(done)
+	}()
+	return unique, func() {
+		close(unique)
+		<-done
+	}
+}
+
+// Classes of the errors of the metrics.
+const (
+	errorTimeout    = "timeout"
+	errorAuth       = "auth"
+	errorConnection = "connection"
+	errorSQL        = "sql"
+	errorOther      = "other"
+)
+
+// Code of the errors of the DM driver and server, kept when the error is wrapped in another one.
+var dmErrorCode = regexp.MustCompile(`Error (-?[0-9]+): `)
+
+// Errors of the DM driver (positive codes) and server (negative codes) telling that the
+// connection or the login failed. The other server errors are SQL errors.
+var (
+	dmConnectionErrors = map[string]bool{"3001": true, "3002": true, "6001": true, "6003": true, "6010": true, "20004": true}
+	dmAuthErrors       = map[string]bool{"-2501": true, "5001": true}
+)
+
+// classifyError returns the DM error code, or none, and the class of an error.
+func classifyError(err error) []string {
+	message := err.Error()
+	if match := dmErrorCode.FindStringSubmatch(message); match != nil {
+		switch code := match[1]; {
+		case dmConnectionErrors[code]:
+			return []string{code, errorConnection}
+		case dmAuthErrors[code]:
+			return []string{code, errorAuth}
+		case strings.HasPrefix(code, "-"):
+			return []string{code, errorSQL}
+		default:
+			return []string{code, errorOther}
+		}
+	}
+	switch {
+	case err == context.DeadlineExceeded || strings.Contains(message, "timed out") || strings.Contains(message, context.DeadlineExceeded.Error()):
+		return []string{"none", errorTimeout}
+	case err == driver.ErrBadConn || strings.Contains(message, "database is closed"):
+		return []string{"none", errorConnection}
+	}
+	if _, ok := err.(net.Error); ok {
+		return []string{"none", errorConnection}
+	}
+	return []string{"none", errorOther}
+}
+
+// scrapeFailed makes a failed metric fail the whole scrape with an HTTP error
+// when --web.error-handling=http-error. Otherwise it is only logged and counted.
+func scrapeFailed(ch chan<- prometheus.Metric, context string, err error) {
+	if *errorHandling != "http-error" {
+		return
+	}
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "scrape_error"),
+		"Error while scraping "+context+".", nil, nil)
+	ch <- prometheus.NewInvalidMetric(desc, errors.New("error scraping "+context+": "+err.Error()))
+}
+
+// evaluateCondition runs the guard query of a metric, which must return a single
+// numeric value. The metric is scraped only when that value is not zero.
+func evaluateCondition(ctx context.Context, db *sql.DB, condition string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var result string
+	if err := db.QueryRowContext(ctx, condition).Scan(&result); err != nil {
+		return false, err
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(result), 64)
+	if err != nil {
+		return false, errors.New("Condition must return a number, got <" + result + ">")
+	}
+	return value != 0, nil
+}
+
+// parseTimeWindow parses a "[days ]HH:MM-HH:MM" window, days being a comma
+// separated list of weekdays or weekday ranges (e.g. "Mon-Fri,Sun").
+func parseTimeWindow(window string) (timeWindow, error) {
+	var parsed timeWindow
+	fields := strings.Fields(window)
+	if len(fields) == 0 || len(fields) > 2 {
+		return parsed, errors.New("Invalid time window <" + window + ">")
+	}
+	if len(fields) == 2 {
+		parsed.days = make(map[time.Weekday]bool)
+		for _, days := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(strings.ToLower(days), "-", 2)
+			first, ok := weekdays[bounds[0]]
+			if !ok {
+				return parsed, errors.New("Invalid weekday " + bounds[0] + " in time window <" + window + ">")
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, ok = weekdays[bounds[1]]; !ok {
+					return parsed, errors.New("Invalid weekday " + bounds[1] + " in time window <" + window + ">")
+				}
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				parsed.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+	hours := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(hours) != 2 {
+		return parsed, errors.New("Invalid time range in time window <" + window + ">")
+	}
+	for i, hour := range hours {
+		t, err := time.Parse("15:04", hour)
+		if err != nil {
+			return parsed, errors.New("Invalid time " + hour + " in time window <" + window + ">")
+		}
+		if i == 0 {
+			parsed.start = t.Hour()*60 + t.Minute()
+		} else {
+			parsed.end = t.Hour()*60 + t.Minute()
+		}
+	}
+	return parsed, nil
+}
+
+// contains tells whether t falls within the window.
+func (w timeWindow) contains(t time.Time) bool {
+	if w.days != nil && !w.days[t.Weekday()] {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// inSchedule tells whether a metric may be scraped at t: within one of its
+// schedule windows, if any, and outside all of its blackout windows.
+func (m Metric) inSchedule(t time.Time) bool {
+	for _, window := range m.blackoutWindows {
+		if window.contains(t) {
+			return false
+		}
+	}
+	if len(m.scheduleWindows) == 0 {
+		return true
+	}
+	for _, window := range m.scheduleWindows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencySatisfied waits for every metric of the context a metric depends on
+// and tells whether they all succeeded and its threshold, if any, is exceeded.
+func dependencySatisfied(dependency *Dependency, state *contextState) bool {
+	if state == nil {
+		return false
+	}
+	state.wg.Wait()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.failed || state.scraped == 0 {
+		return false
+	}
+	if dependency.Metric == "" {
+		return true
+	}
+	return state.totals[dependency.Metric] > float64(dependency.Above)
+}
+
+// checkDependencies makes sure every dependency targets a known context and
+// that dependencies do not form a cycle, which would block the scrape forever.
+func checkDependencies(metrics []Metric) error {
+	graph := make(map[string][]string)
+	for _, metric := range metrics {
+		if _, ok := graph[metric.Context]; !ok {
+			graph[metric.Context] = []string{}
+		}
+	}
+	for _, metric := range metrics {
+		if metric.DependsOn == nil {
+			continue
+		}
+		if _, ok := graph[metric.DependsOn.Context]; !ok {
+			return errors.New("Metric " + metric.Context + " depends on unknown context " + metric.DependsOn.Context)
+		}
+		graph[metric.Context] = append(graph[metric.Context], metric.DependsOn.Context)
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int)
+	var visit func(context string) error
+	visit = func(context string) error {
+		switch marks[context] {
+		case visiting:
+			return errors.New("Dependency cycle detected on context " + context)
+		case visited:
+			return nil
+		}
+		marks[context] = visiting
+		for _, dependency := range graph[context] {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		marks[context] = visited
+		return nil
+	}
+	for context := range graph {
+		if err := visit(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryContext bounds a query to the query timeout on top of the given context, or to the
+// timeout of its metric with --query.timeout-factor.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(timeoutKey{}).(time.Duration); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	timeout, err := strconv.Atoi(*queryTimeout)
+	if err != nil {
+		log.Fatal("error while converting timeout option value: ", err)
+		panic(err)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+}
+
+// queryStats is the moving average of the duration of the request of a metric, and the
+// timeout it last ran with.
+type queryStats struct {
+	context string
+	samples int
+	average float64
+	timeout float64
+	// Whether the average was logged as more than half of --query.timeout
+	slow bool
+}
+
+var (
+	queryStatsMu sync.Mutex
+	// By context and request
+	queryStatsByRequest = make(map[string]*queryStats)
+	averageDuration     = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "collector_average_duration_seconds"),
+		"Moving average of the duration of the requests of the context, the slowest one when it has several.", []string{"context"}, nil)
+	adaptedTimeout = prometheus.NewDesc(prometheus.BuildFQName(namespace, exporter, "collector_timeout_seconds"),
+		"Timeout of the requests of the context set from their average duration with --query.timeout-factor, the longest one when it has several.", []string{"context"}, nil)
+)
+
+// adaptiveTimeout returns ctx with the timeout of the request of a metric, when set from its
+// average duration, and the function recording the duration of the request given its error.
+// Only the requests succeeding or timing out count, failing fast does not tell how long they last.
+func adaptiveTimeout(ctx context.Context, name string, request string) (context.Context, func(err error)) {
+	maxTimeout, _ := strconv.Atoi(*queryTimeout)
+	key := name + "_" + request
+	queryStatsMu.Lock()
+	stats, ok := queryStatsByRequest[key]
+	if !ok {
+		stats = &queryStats{context: name}
+		queryStatsByRequest[key] = stats
+	}
+	timeout := float64(maxTimeout)
+	if *timeoutFactor > 0 && stats.samples >= adaptiveSamples {
+		timeout = math.Min(math.Max(*timeoutFactor*stats.average, minAdaptiveTimeout), timeout)
+	}
+	stats.timeout = timeout
+	queryStatsMu.Unlock()
+	if *timeoutFactor > 0 {
+		ctx = context.WithValue(ctx, timeoutKey{}, time.Duration(timeout*float64(time.Second)))
+	}
+	begun := time.Now()
+	return ctx, func(err error) {
+		if err != nil && classifyError(err)[1] != errorTimeout {
+			return
+		}
+		duration := time.Since(begun).Seconds()
+		queryStatsMu.Lock()
+		defer queryStatsMu.Unlock()
+		if stats.samples == 0 {
+			stats.average = duration
+		} else {
+			stats.average += durationWeight * (duration - stats.average)
+		}
+		stats.samples++
+		// Flags the requests getting close to the timeout, e.g. on a growing table
+		if slow := stats.samples >= adaptiveSamples && stats.average > float64(maxTimeout)/2; slow != stats.slow {
+			stats.slow = slow
+			if slow {
+				requestLogger(ctx).Warnln("Metric", name, "lasts", strconv.FormatFloat(stats.average, 'f', 3, 64),
+					"seconds on average, more than half of --query.timeout")
+			}
+		}
+	}
+}
+
+// pruneQueryStats forgets the durations of the requests no longer loaded.
+func pruneQueryStats() {
+	loaded := make(map[string]bool)
+	metrics, _ := currentMetrics()
+	for _, metric := range metrics.Metric {
+		loaded[metric.Context+"_"+metric.Request] = true
+	}
+	queryStatsMu.Lock()
+	defer queryStatsMu.Unlock()
+	for key := range queryStatsByRequest {
+		if !loaded[key] {
+			delete(queryStatsByRequest, key)
+		}
+	}
+}
+
+// collectQueryStats sends the average duration of the requests of each context, and their
+// timeout with --query.timeout-factor.
+func collectQueryStats(ch chan<- prometheus.Metric) {
+	queryStatsMu.Lock()
+	defer queryStatsMu.Unlock()
+	averages := make(map[string]float64)
+	timeouts := make(map[string]float64)
+	for _, stats := range queryStatsByRequest {
+		if stats.samples == 0 {
+			continue
+		}
+		averages[stats.context] = math.Max(averages[stats.context], stats.average)
+		timeouts[stats.context] = math.Max(timeouts[stats.context], stats.timeout)
+	}
+	for context, average := range averages {
+		ch <- prometheus.MustNewConstMetric(averageDuration, prometheus.GaugeValue, average, context)
+		if *timeoutFactor > 0 {
+			ch <- prometheus.MustNewConstMetric(adaptedTimeout, prometheus.GaugeValue, timeouts[context], context)
+		}
+	}
+}
+
+// restrictsRole returns whether one of metrics is only scraped on primary or standby instances.
+func restrictsRole(metrics []Metric) bool {
+	for _, metric := range metrics {
+		if metric.Role != "" && !strings.EqualFold(metric.Role, roleAny) {
+			return true
+		}
+	}
+	return false
+}
+
+// getInstanceRole returns whether the DM instance currently runs as primary or standby.
+// Standalone instances (MODE$ = NORMAL) are considered primary.
+func getInstanceRole(ctx context.Context, db *sql.DB) (string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var mode string
+	if err := db.QueryRowContext(ctx, "SELECT MODE$ FROM V$INSTANCE").Scan(&mode); err != nil {
+		return "", err
+	}
+	if strings.EqualFold(strings.TrimSpace(mode), "STANDBY") {
+		return roleStandby, nil
+	}
+	return rolePrimary, nil
+}
+
+// DM parameters exported by scrapeParameters, from --parameters.names.
+var parameterNames []string
+
+// Name of a DM parameter, checked before it is put in the query.
+var parameterName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Parameters with a numeric value are exported as gauges, the others as info metrics.
+var (
+	parameterValueDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "parameter", "value"),
+		"Value of a DM parameter of V$DM_INI.",
+		[]string{"name"}, nil,
+	)
+	parameterInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "parameter", "info"),
+		"Non-numeric value of a DM parameter of V$DM_INI.",
+		[]string{"name", "value"}, nil,
+	)
+)
+
+// scrapeParameters exports the values of the parameters of --parameters.names, so that
+// configuration drift across instances can be compared and alerted on.
+func scrapeParameters(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, logger log.Logger) {
+	if len(parameterNames) == 0 {
+		return
+	}
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	found := make(map[string]bool)
+	query := "SELECT PARA_NAME, PARA_VALUE FROM V$DM_INI WHERE PARA_NAME IN ('" + strings.Join(parameterNames, "', '") + "')"
+	err := GeneratePrometheusMetrics(ctx, db, func(row map[string]string) error {
+		name, value := strings.ToUpper(row["para_name"]), strings.TrimSpace(row["para_value"])
+		found[name] = true
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			ch <- prometheus.MustNewConstMetric(parameterValueDesc, prometheus.GaugeValue, number, name)
+		} else {
+			ch <- prometheus.MustNewConstMetric(parameterInfoDesc, prometheus.GaugeValue, 1, name, value)
+		}
+		return nil
+	}, query)
+	if err != nil {
+		logger.Errorln("Error scraping the DM parameters:", err)
+		recordError("parameters", err)
+		return
+	}
+	for _, name := range parameterNames {
+		if !found[name] {
+			logger.Debugln("DM parameter", name, "not found in V$DM_INI")
+		}
+	}
+}
+
+// Version of the DM server in its SVR_VERSION, e.g. 8 in "DM Database Server 64 V8".
+var serverVersion = regexp.MustCompile(`V([0-9]+(?:\.[0-9]+)*)`)
+
+// getVersion returns the version of the DM server behind db, detected once per connection.
+func (e *Exporter) getVersion(ctx context.Context, db *sql.DB) (string, error) {
+	e.versionMu.Lock()
+	defer e.versionMu.Unlock()
+	if db == e.versionDB {
+		return e.version, nil
+	}
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var banner string
+	if err := db.QueryRowContext(ctx, "SELECT SVR_VERSION FROM V$INSTANCE").Scan(&banner); err != nil {
+		return "", err
+	}
+	match := serverVersion.FindStringSubmatch(banner)
+	if match == nil {
+		return "", errors.New("Unable to find the version in <" + banner + ">")
+	}
+	requestLogger(ctx).Infoln("DM server version is", match[1])
+	e.versionDB, e.version = db, match[1]
+	return e.version, nil
+}
+
+// Versions of minversion and maxversion.
+var versionNumber = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// compareVersions compares dotted versions such as 8 and 7.6, returning -1, 0 or 1.
+func compareVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bPart, _ = strconv.Atoi(bParts[i])
+		}
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// atMost tells whether a version is at most max, which covers its minor versions: 7.6.1
+// is at most 7.
+func atMost(version, max string) bool {
+	parts := strings.Split(version, ".")
+	if n := strings.Count(max, ".") + 1; len(parts) > n {
+		version = strings.Join(parts[:n], ".")
+	}
+	return compareVersions(version, max) <= 0
+}
+
+// inVersions tells whether a metric applies to a version of DM.
+func (m Metric) inVersions(version string) bool {
+	if strings.Compare(m.MinVersion, "") != 0 && compareVersions(version, m.MinVersion) < 0 {
+		return false
+	}
+	return strings.Compare(m.MaxVersion, "") == 0 || atMost(version, m.MaxVersion)
+}
+
+func GetMetricType(metricType string, metricsType map[string]string) prometheus.ValueType {
+	var strToPromType = map[string]prometheus.ValueType{
+		"gauge":   prometheus.GaugeValue,
+		"counter": prometheus.CounterValue,
+		// Built from several columns, see parseHistogram and parseSummary
+		metricTypeHistogram: prometheus.UntypedValue,
+		metricTypeSummary:   prometheus.UntypedValue,
+		// Always 1, see infolabels
+		metricTypeInfo: prometheus.GaugeValue,
+	}
+
+	strType, ok := metricsType[strings.ToLower(metricType)]
+	if !ok {
+		return prometheus.GaugeValue
+	}
+	valueType, ok := strToPromType[strings.ToLower(strType)]
+	if !ok {
+		panic(errors.New("Error while getting prometheus type " + strings.ToLower(strType)))
+	}
+	return valueType
+}
+
+// Metric types built from several columns rather than a single value.
+const (
+	metricTypeHistogram = "histogram"
+	metricTypeSummary   = "summary"
+	metricTypeInfo      = "info"
+)
+
+// mapValue converts a textual status to the number it is mapped to in valuemap, if any.
+func mapValue(mapping map[string]string, value string) string {
+	value = strings.TrimSpace(value)
+	for text, number := range mapping {
+		if strings.EqualFold(text, value) {
+			return number
+		}
+	}
+	return value
+}
+
+// parseValue converts the text of a column to a number according to its format. Timestamps
+// are read with timeLayout, if set, in timeLocation.
+func parseValue(format string, text string, timeLayout string, timeLocation *time.Location) (float64, error) {
+	switch strings.ToLower(format) {
+	case formatDuration:
+		return parseDuration(text)
+	case formatTimestamp:
+		layouts := timeLayouts
+		if strings.Compare(timeLayout, "") != 0 {
+			layouts = []string{timeLayout}
+		}
+		if timeLocation == nil {
+			timeLocation = time.Local
+		}
+		t, err := parseTimeIn(text, layouts, timeLocation)
+		if err != nil {
+			return 0, err
+		}
+		return float64(t.UnixNano()) / float64(time.Second), nil
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// DM intervals, e.g. "0 00:12:34.567" or "-1 12:00:00", and times of day such as "12:34:56".
+var durationValue = regexp.MustCompile(`^([+-])?(?:([0-9]+) +)?([0-9]+):([0-9]+)(?::([0-9]+(?:\.[0-9]*)?))?$`)
+
+// parseDuration converts an interval to seconds.
+func parseDuration(text string) (float64, error) {
+	match := durationValue.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return 0, errors.New("Unable to parse duration <" + text + ">")
+	}
+	days, _ := strconv.ParseFloat("0"+match[2], 64)
+	hours, _ := strconv.ParseFloat(match[3], 64)
+	minutes, _ := strconv.ParseFloat(match[4], 64)
+	seconds, _ := strconv.ParseFloat("0"+match[5], 64)
+	duration := days*86400 + hours*3600 + minutes*60 + seconds
+	if match[1] == "-" {
+		duration = -duration
+	}
+	return duration, nil
+}
+
+// Numbers formatted for display, e.g. "1,234,567.89", "1 234 567" or "45.2 %".
+var (
+	groupedNumber  = regexp.MustCompile(`^[+-]?[0-9]{1,3}([, _][0-9]{3})+(\.[0-9]*)?([eE][+-]?[0-9]+)?$`)
+	groupSeparator = regexp.MustCompile(`[, _]`)
+)
+
+// formattedNumber removes the thousands separators and the percent sign of a number
+// formatted for display. Percentages are kept as is, 45.2 % being read as 45.2.
+func formattedNumber(text string) string {
+	text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "%"))
+	if groupedNumber.MatchString(text) {
+		text = groupSeparator.ReplaceAllString(text, "")
+	}
+	return text
+}
+
+// booleanValue converts the usual representations of booleans in DM views to 1 or 0.
+func booleanValue(value string) string {
+	switch strings.ToUpper(value) {
+	case "Y", "YES", "TRUE", "ON":
+		return "1"
+	case "N", "NO", "FALSE", "OFF":
+		return "0"
+	}
+	return value
+}
+
+// compositeColumns returns the columns of the histogram or summary metric in a row. When the row
+// has a <metric>_count column, only the columns prefixed with the name of the metric are used,
+// without the prefix, so that a row can hold several histograms or summaries.
+func compositeColumns(row map[string]string, metric string) map[string]string {
+	prefix := strings.ToLower(metric) + "_"
+	if _, ok := row[prefix+"count"]; !ok {
+		return row
+	}
+	columns := make(map[string]string)
+	for column, value := range row {
+		if strings.HasPrefix(column, prefix) {
+			columns[strings.TrimPrefix(column, prefix)] = value
+		}
+	}
+	return columns
+}
+
+// Quantile columns of a summary, e.g. q50 for the 0.5 quantile or q999 for the 0.999 one.
+var quantileColumn = regexp.MustCompile(`^q([0-9]+)$`)
+
+// parseSummary reads a summary from the count, sum and quantile columns of a row.
+func parseSummary(row map[string]string) (uint64, float64, map[float64]float64, error) {
+	count, err := strconv.ParseFloat(strings.TrimSpace(row["count"]), 64)
+	if err != nil {
+		return 0, 0, nil, errors.New("invalid count <" + row["count"] + ">")
+	}
+	sum, err := strconv.ParseFloat(strings.TrimSpace(row["sum"]), 64)
+	if err != nil {
+		return 0, 0, nil, errors.New("invalid sum <" + row["sum"] + ">")
+	}
+	quantiles := make(map[float64]float64)
+	for column, value := range row {
+		match := quantileColumn.FindStringSubmatch(column)
+		if match == nil {
+			continue
+		}
+		quantile, _ := strconv.ParseFloat("0."+match[1], 64)
+		quantiles[quantile], err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, 0, nil, errors.New("invalid quantile " + column + " <" + value + ">")
+		}
+	}
+	return uint64(count), sum, quantiles, nil
+}
+
+// parseHistogram reads a histogram from the count, sum and bucket columns of a row. Buckets are
+// the columns mapped to their upper bound in metricsbuckets or, by default, the le_* columns, the
+// bound being the rest of the name with _ as decimal point (le_0_5 for 0.5).
+func parseHistogram(row map[string]string, metricBuckets map[string]string) (uint64, float64, map[float64]uint64, error) {
+	count, err := strconv.ParseFloat(strings.TrimSpace(row["count"]), 64)
+	if err != nil {
+		return 0, 0, nil, errors.New("invalid count <" + row["count"] + ">")
+	}
+	sum, err := strconv.ParseFloat(strings.TrimSpace(row["sum"]), 64)
+	if err != nil {
+		return 0, 0, nil, errors.New("invalid sum <" + row["sum"] + ">")
+	}
+	if len(metricBuckets) == 0 {
+		metricBuckets = make(map[string]string)
+		for column := range row {
+			if strings.HasPrefix(column, "le_") {
+				metricBuckets[column] = strings.Replace(strings.TrimPrefix(column, "le_"), "_", ".", -1)
+			}
+		}
+	}
+	buckets := make(map[float64]uint64)
+	for column, le := range metricBuckets {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(le), 64)
+		if err != nil {
+			return 0, 0, nil, errors.New("invalid upper bound " + le + " of bucket " + column)
+		}
+		// The +Inf bucket is the count
+		if math.IsInf(bound, 1) {
+			continue
+		}
+		cumulative, err := strconv.ParseFloat(strings.TrimSpace(row[strings.ToLower(column)]), 64)
+		if err != nil {
+			return 0, 0, nil, errors.New("invalid bucket " + column + " <" + row[strings.ToLower(column)] + ">")
+		}
+		buckets[bound] = uint64(cumulative)
+	}
+	// Each bucket counts the observations of the smaller ones, and is counted by the +Inf one
+	bounds := make([]float64, 0, len(buckets))
+	for bound := range buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	previous := uint64(0)
+	for _, bound := range append(bounds, math.Inf(1)) {
+		cumulative, ok := buckets[bound]
+		if !ok {
+			cumulative = uint64(count)
+		}
+		if cumulative < previous {
+			return 0, 0, nil, errors.New("buckets are not cumulative, bucket " +
+				strconv.FormatFloat(bound, 'g', -1, 64) + " <" + strconv.FormatUint(cumulative, 10) + "> is below the previous one")
+		}
+		previous = cumulative
+	}
+	return uint64(count), sum, buckets, nil
+}
+
+func newDimensionCache(ctx context.Context, db *sql.DB, dimensions []Dimension) *dimensionCache {
+	cache := &dimensionCache{ctx: ctx, db: db, results: make(map[string]*dimensionResult)}
+	for _, dimension := range dimensions {
+		cache.results[dimension.Name] = &dimensionResult{dimension: dimension}
+	}
+	return cache
+}
+
+// get returns a dimension and its rows by key, running its query on first use.
+func (c *dimensionCache) get(name string) (Dimension, map[string]map[string]string, error) {
+	result, ok := c.results[name]
+	if !ok {
+		return Dimension{}, nil, errors.New("Unknown dimension " + name)
+	}
+	result.once.Do(func() {
+		log.Debugln("Running dimension query: ", name)
+		result.rows = make(map[string]map[string]string)
+		result.err = GeneratePrometheusMetrics(c.ctx, c.db, func(row map[string]string) error {
+			result.rows[row[result.dimension.Key]] = row
+			return nil
+		}, tagQuery(c.ctx, name, result.dimension.Request))
+	})
+	return result.dimension, result.rows, result.err
+}
+
+func newQueryCache(ctx context.Context, db *sql.DB, queries []Query) *queryCache {
+	cache := &queryCache{ctx: ctx, db: db, results: make(map[string]*queryResult)}
+	for _, query := range queries {
+		cache.results[query.Name] = &queryResult{query: query}
+	}
+	return cache
+}
+
+// get returns the rows of a shared query, running it on first use or until it succeeds.
+func (c *queryCache) get(name string) ([]map[string]string, error) {
+	result, ok := c.results[name]
+	if !ok {
+		return nil, errors.New("Unknown query " + name)
+	}
+	result.mu.Lock()
+	defer result.mu.Unlock()
+	if result.done {
+		return result.rows, nil
+	}
+	log.Debugln("Running shared query: ", name)
+	rows := []map[string]string{}
+	err := GeneratePrometheusMetrics(c.ctx, c.db, func(row map[string]string) error {
+		rows = append(rows, row)
+		return nil
+	}, tagQuery(c.ctx, name, result.query.Request))
+	if err != nil {
+		return nil, err
+	}
+	result.rows, result.done = rows, true
+	return rows, nil
+}
+
+// interface method to call ScrapeGenericValues using Metric struct values
+func ScrapeMetric(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, metricDefinition Metric,
+	dimensions *dimensionCache, queries *queryCache, totals map[string]float64, counts *scrapeCounts) error {
+	limit := *maxSeries
+	if metricDefinition.MaxSeries > 0 {
+		limit = metricDefinition.MaxSeries
+	}
+	if limit > 0 {
+		// Only the first series get through, the others are counted
+		limited := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		var series, dropped int64
+		go func() {
+			for metric := range limited {
+				if series++; series <= limit {
+					ch <- metric
+				} else {
+					dropped++
+				}
+			}
+			close(done)
+		}()
+		defer func() {
+			close(limited)
+			<-done
+			if dropped > 0 {
+				requestLogger(ctx).Warnln("Metric", metricDefinition.Context, "exported", series, "series, only the first", limit, "are kept")
+				droppedSeries.WithLabelValues(metricDefinition.Context).Add(float64(dropped))
+			}
+		}()
+		ch = limited
+	}
+	var sharedRows []map[string]string
+	if strings.Compare(metricDefinition.QueryRef, "") != 0 {
+		rows, err := queries.get(metricDefinition.QueryRef)
+		if err != nil {
+			return errors.New("query " + metricDefinition.QueryRef + ": " + err.Error())
+		}
+		sharedRows = rows
+	}
+	labels := metricDefinition.Labels
+	var enrich func(row map[string]string)
+	if len(metricDefinition.Dimensions) > 0 {
+		labels = append([]string{}, labels...)
+		joined := []Dimension{}
+		joinedRows := []map[string]map[string]string{}
+		for _, name := range metricDefinition.Dimensions {
+			dimension, rows, err := dimensions.get(name)
+			if err != nil {
+				return errors.New("dimension " + name + ": " + err.Error())
+			}
+			labels = append(labels, dimension.Labels...)
+			joined = append(joined, dimension)
+			joinedRows = append(joinedRows, rows)
+		}
+		enrich = func(row map[string]string) {
+			for i, dimension := range joined {
+				match := joinedRows[i][row[dimension.Key]]
+				for _, label := range dimension.Labels {
+					row[label] = match[label]
+				}
+			}
+		}
+	}
+	constLabels := metricDefinition.ConstLabels
+	if source, ok := ctx.Value(sourceRoleKey{}).(string); ok && !hasLabel(labels, "role") {
+		constLabels = map[string]string{"role": source}
+		for name, value := range metricDefinition.ConstLabels {
+			constLabels[name] = value
+		}
+	}
+	// The definition is a copy, completed for this scrape
+	metricDefinition.Labels = labels
+	metricDefinition.ConstLabels = constLabels
+	metricDefinition.BooleanValues = metricDefinition.BooleanValues || *booleanValues
+	return ScrapeGenericValues(ctx, db, ch, metricDefinition, enrich, sharedRows, totals, counts)
+}
+
+// ScrapeGenericValues scrapes the metrics of a definition, whose labels and constant labels
+// are those of the scrape, e.g. including the labels of its dimensions added by enrich. The
+// rows of its shared query are parsed instead of querying the database when not nil. The
+// values of each metric are summed up in totals, and the rows and series in counts, when not nil.
+func ScrapeGenericValues(ctx context.Context, db *sql.DB, ch chan<- prometheus.Metric, definition Metric,
+	enrich func(row map[string]string), sharedRows []map[string]string, totals map[string]float64, counts *scrapeCounts) error {
+	logger := requestLogger(ctx)
+	metricsCount := 0
+	rowsCount := 0
+	genericParser := func(row map[string]string) error {
+		if definition.MaxRows > 0 && int64(rowsCount) >= definition.MaxRows {
+			return errMaxRows
+		}
+		rowsCount++
+		// Add the columns of joined dimensions
+		if enrich != nil {
+			enrich(row)
+		}
+		// Label statements by fingerprint rather than by their text
+		for _, column := range definition.Fingerprints {
+			row[column] = sqlFingerprint(row[column])
+		}
+		if definition.Sanitize != nil {
+			for _, column := range definition.Sanitize.Labels {
+				row[column] = definition.Sanitize.apply(row[column])
+			}
+		}
+		// Construct labels value
+		labelsValues := []string{}
+		for _, label := range definition.Labels {
+			labelsValues = append(labelsValues, row[label])
+		}
+		// Flag outdated data instead of exporting it
+		if strings.Compare(definition.FreshnessColumn, "") != 0 {
+			stale := 0.0
+			refreshed, err := parseTime(row[definition.FreshnessColumn])
+			if err != nil {
+				logger.Errorln("Unable to convert freshness column to a time (column=" + definition.FreshnessColumn +
+					",value=<" + row[definition.FreshnessColumn] + ">)")
+				stale = 1
+			} else if time.Since(refreshed) > time.Duration(definition.MaxAge)*time.Second {
+				logger.Debugln("Data of ", definition.Context, " is stale, refreshed at ", refreshed)
+				stale = 1
+			}
+			desc := prometheus.NewDesc(
+				definition.fqName("stale"),
+				"Whether the data is older than its max age ("+strconv.FormatInt(definition.MaxAge, 10)+"s).",
+				definition.Labels, definition.ConstLabels,
+			)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, stale, labelsValues...)
+			metricsCount++
+			if stale == 1 {
+				return nil
+			}
+		}
+		// Stamp the samples with the time the data was computed instead of the scrape time
+		send := func(metric prometheus.Metric) { ch <- metric }
+		if strings.Compare(definition.TimestampColumn, "") != 0 {
+			timestamp, err := parseTime(row[definition.TimestampColumn])
+			if err != nil {
+				logConversionError(logger, definition.Context, definition.TimestampColumn, definition.ConversionLog, "Unable to convert timestamp column to a time (column="+
+					definition.TimestampColumn+",value=<"+row[definition.TimestampColumn]+">), using the scrape time")
+			} else {
+				send = func(metric prometheus.Metric) { ch <- prometheus.NewMetricWithTimestamp(timestamp, metric) }
+			}
+		}
+		// Construct Prometheus values to sent back
+		for metric, metricHelp := range definition.MetricsDesc {
+			// Columns declared as strings are labels, not values
+			if strings.EqualFold(definition.ColumnTypes[metric], columnString) {
+				continue
+			}
+			valueType := GetMetricType(metric, definition.MetricsType)
+			metricType := strings.ToLower(definition.MetricsType[strings.ToLower(metric)])
+			// Unless the metric is named after the content of a field, keeping its labels
+			name, variableLabels, values := metric, definition.Labels, labelsValues
+			if len(definition.FieldToAppend) > 0 {
+				parts := []string{}
+				for _, column := range definition.FieldToAppend {
+					parts = append(parts, definition.Sanitize.apply(row[column]))
+				}
+				name = strings.Join(parts, "_")
+			}
+			// Info metrics carry their string columns as labels
+			if strings.Compare(metricType, metricTypeInfo) == 0 {
+				variableLabels = append(append([]string{}, variableLabels...), definition.InfoLabels[metric]...)
+				values = append([]string{}, values...)
+				for _, column := range definition.InfoLabels[metric] {
+					values = append(values, row[column])
+				}
+			}
+			desc := prometheus.NewDesc(
+				definition.fqName(name),
+				metricHelp,
+				variableLabels, definition.ConstLabels,
+			)
+			// During a rename, samples are also exported under the deprecated name
+			var aliasDesc *prometheus.Desc
+			if alias := definition.Aliases[metric]; *emitDeprecated && strings.Compare(alias, "") != 0 {
+				aliasDesc = prometheus.NewDesc(alias,
+					"Deprecated, use "+definition.fqName(name)+". "+metricHelp,
+					variableLabels, definition.ConstLabels,
+				)
+			}
+			emit := func(m prometheus.Metric) {
+				send(m)
+				metricsCount++
+				if aliasDesc != nil {
+					send(renamedMetric{m, aliasDesc})
+					metricsCount++
+				}
+			}
+			if strings.Compare(metricType, metricTypeHistogram) == 0 {
+				count, sum, buckets, err := parseHistogram(compositeColumns(row, metric), definition.MetricsBuckets[metric])
+				if err != nil {
+					if !inMaintenance(ctx) {
+						parseFailures.WithLabelValues(definition.Context, metric).Inc()
+					}
+					logConversionError(logger, definition.Context, metric, definition.ConversionLog, "Unable to convert histogram (metric="+metric+
+						",metricHelp="+metricHelp+"): "+err.Error())
+					continue
+				}
+				if totals != nil {
+					totals[metric] += sum
+				}
+				emit(prometheus.MustNewConstHistogram(desc, count, sum, buckets, values...))
+				continue
+			}
+			if strings.Compare(metricType, metricTypeInfo) == 0 {
+				emit(prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...))
+				continue
+			}
+			if strings.Compare(metricType, metricTypeSummary) == 0 {
+				count, sum, quantiles, err := parseSummary(compositeColumns(row, metric))
+				if err != nil {
+					if !inMaintenance(ctx) {
+						parseFailures.WithLabelValues(definition.Context, metric).Inc()
+					}
+					logConversionError(logger, definition.Context, metric, definition.ConversionLog, "Unable to convert summary (metric="+metric+
+						",metricHelp="+metricHelp+"): "+err.Error())
+					continue
+				}
+				if totals != nil {
+					totals[metric] += sum
+				}
+				emit(prometheus.MustNewConstSummary(desc, count, sum, quantiles, values...))
+				continue
+			}
+			raw := row[metric]
+			if strings.Compare(raw, nullValue) == 0 {
+				switch strings.ToLower(definition.NullPolicy) {
+				case nullSkip:
+					logger.Debugln("Skipping NULL value of ", metric)
+					continue
+				case nullZero:
+					raw = "0"
+				case nullNaN:
+					raw = "NaN"
+				}
+			}
+			text := mapValue(definition.ValueMap[metric], raw)
+			if definition.BooleanValues {
+				text = booleanValue(text)
+			}
+			if !definition.StrictValues && strings.Compare(definition.Format[metric], "") == 0 {
+				text = formattedNumber(text)
+			}
+			value, err := parseValue(definition.Format[metric], text, definition.TimeLayout, definition.timeLocation)
+			// If not a float, skip current metric
+			if err != nil {
+				if !inMaintenance(ctx) {
+					parseFailures.WithLabelValues(definition.Context, metric).Inc()
+				}
+				logConversionError(logger, definition.Context, metric, definition.ConversionLog, "Unable to convert current value to float (metric="+metric+
+					",metricHelp="+metricHelp+",value=<"+row[metric]+">)")
+				continue
+			}
+			logger.Debugln("Query result looks like: ", value)
+			// Convert to base units
+			if factor, ok := definition.scaleFactors[metric]; ok {
+				value *= factor
+			}
+			if totals != nil {
+				totals[metric] += value
+			}
+			emit(withExemplar(prometheus.MustNewConstMetric(desc, valueType, value, values...),
+				valueType, definition.ExemplarLabels, row, value))
+		}
+		return nil
+	}
+	var err error
+	if sharedRows != nil {
+		// Rows of a shared query, copied as the parser adds columns to them
+		for _, shared := range sharedRows {
+			row := make(map[string]string, len(shared))
+			for column, value := range shared {
+				row[column] = value
+			}
+			if err = genericParser(row); err != nil {
+				break
+			}
+		}
+	} else {
+		queryCtx, observe := adaptiveTimeout(ctx, definition.Context, definition.Request)
+		err = GeneratePrometheusMetrics(queryCtx, db, genericParser, tagQuery(ctx, definition.Context, definition.Request))
+		observe(err)
+	}
+	if err == errBudget {
+		budgetExceeded.WithLabelValues(definition.Context).Inc()
+		err = errOverBudget
+	}
+	if err == errMaxRows {
+		if strings.EqualFold(definition.MaxRowsAction, maxRowsTruncate) {
+			logger.Warnln("Metric", definition.Context, "returned more than", definition.MaxRows, "rows, only the first ones are exported")
+			truncatedScrapes.WithLabelValues(definition.Context).Inc()
+			err = nil
+		} else {
+			err = errors.New("more than " + strconv.FormatInt(definition.MaxRows, 10) + " rows returned, see maxrows")
+		}
+	}
+	if counts != nil {
+		atomic.AddInt64(&counts.rows, int64(rowsCount))
+		atomic.AddInt64(&counts.series, int64(metricsCount))
+	}
+	if err != nil {
+		return err
+	}
+	if !definition.IgnoreZeroResult && metricsCount == 0 {
+		return errors.New("No metrics found while parsing")
+	}
+	return err
+}
+
+// errorLog is the last error logged for a metric.
+type errorLog struct {
+	message    string
+	time       time.Time
+	suppressed int
+}
+
+// logScrapeError logs the error of a metric, nil once the metric succeeds again. The same
+// error is logged at most once per --log.error-interval, along with the number of times it
+// was suppressed in between, so that a metric failing on every scrape does not flood the logs.
+func logScrapeError(logger log.Logger, metric Metric, err error) {
+	logThrottledError(logger, metric.Context+"_"+metric.Request, metric.Context, "Metric "+metric.Context, err,
+		"Error scraping for", metric.Context, "_", metric.MetricsDesc, ":")
+}
+
+// logRoleError logs the error of the query of the instance role like the errors of a metric.
+func logRoleError(logger log.Logger, err error) {
+	logThrottledError(logger, "instance_role", "instance_role", "Instance role", err,
+		"Error while getting instance role, only metrics without role will be scraped:")
+}
+
+// logThrottledError logs err after prefix at most once per --log.error-interval and key, counting the
+// suppressed ones under context, and logs the recovery of name once err is nil again.
+func logThrottledError(logger log.Logger, key string, context string, name string, err error, prefix ...interface{}) {
+	errorLogMu.Lock()
+	defer errorLogMu.Unlock()
+	last, ok := errorLogLast[key]
+	if err == nil {
+		if ok {
+			delete(errorLogLast, key)
+			if last.suppressed > 0 {
+				logger.Infoln(name, "recovered,", last.suppressed, "errors were not logged")
+			}
+		}
+		return
+	}
+	message := err.Error()
+	interval := time.Duration(*errorLogEvery) * time.Second
+	if ok && last.message == message && time.Since(last.time) < interval {
+		last.suppressed++
+		errorLogLast[key] = last
+		suppressedErrors.WithLabelValues(context).Inc()
+		return
+	}
+	if ok && last.message == message && last.suppressed > 0 {
+		logger.Errorln(append(prefix, err, "("+strconv.Itoa(last.suppressed)+" similar errors suppressed)")...)
+	} else {
+		logger.Errorln(append(prefix, err)...)
+	}
+	errorLogLast[key] = errorLog{message: message, time: time.Now()}
+}
+
+// logConversionError logs a conversion error of a metric at its conversion log level.
+// Errors are logged at most once per --log.conversion-interval and metric, along with
+// the number of errors suppressed in between.
+func logConversionError(logger log.Logger, context string, metric string, level string, message string) {
+	if strings.EqualFold(level, conversionLogDebug) {
+		logger.Debugln(message)
+		return
+	}
+	key := context + "_" + metric
+	conversionLogMu.Lock()
+	defer conversionLogMu.Unlock()
+	interval := time.Duration(*conversionLogEvery) * time.Second
+	if last, ok := conversionLogLast[key]; ok && time.Since(last) < interval {
+		conversionSkipped[key]++
+		return
+	}
+	if skipped := conversionSkipped[key]; skipped > 0 {
+		message += " (" + strconv.Itoa(skipped) + " similar errors suppressed)"
+	}
+	logger.Errorln(message)
+	conversionLogLast[key] = time.Now()
+	conversionSkipped[key] = 0
+}
+
+// Layouts tried, in order, to read a time from a query result.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC3339Nano,
+}
+
+// parseTime reads a time from a query result, either a DATE/TIMESTAMP column
+// or a number of seconds since the epoch.
+func parseTime(value string) (time.Time, error) {
+	return parseTimeIn(value, timeLayouts, time.Local)
+}
+
+// parseTimeIn reads a time with one of layouts, in location unless the time has a zone.
+func parseTimeIn(value string, layouts []string, location *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if epoch, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(epoch*float64(time.Second))), nil
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Unable to parse time <" + value + ">")
+}
+
+// exemplarMetric is a counter sample carrying an exemplar, only exposed in the OpenMetrics format.
+type exemplarMetric struct {
+	prometheus.Metric
+	exemplar *dto.Exemplar
+}
+
+// Write implements prometheus.Metric.
+func (m exemplarMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	if out.Counter != nil {
+		out.Counter.Exemplar = m.exemplar
+	}
+	return nil
+}
+
+// withExemplar attaches the given columns of the row as an exemplar to counter samples.
+func withExemplar(metric prometheus.Metric, valueType prometheus.ValueType, exemplarLabels []string,
+	row map[string]string, value float64) prometheus.Metric {
+	if len(exemplarLabels) == 0 || valueType != prometheus.CounterValue {
+		return metric
+	}
+	exemplar := &dto.Exemplar{Value: &value}
+	for _, label := range exemplarLabels {
+		name, labelValue := label, row[label]
+		exemplar.Label = append(exemplar.Label, &dto.LabelPair{Name: &name, Value: &labelValue})
+	}
+	return exemplarMetric{Metric: metric, exemplar: exemplar}
+}
+
+// Transaction isolation levels of --database.isolation, queries running outside of a transaction by default.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read-uncommitted": sql.LevelReadUncommitted,
+	"read-committed":   sql.LevelReadCommitted,
+	"serializable":     sql.LevelSerializable,
+}
+
+// statementSet holds the statements prepared with --query.prepare, by database and request.
+// database/sql prepares a statement again on each connection of the pool it runs on. Each
+// scrape uses the current set until it is over, so that a reload of the metrics files does
+// not close the statements of the running scrapes.
+type statementSet struct {
+	byDB map[*sql.DB]map[string]*sql.Stmt
+	// Scrapes using the set, which is closed once retired and no longer used
+	users   int
+	retired bool
+}
+
+// statementsKey is the context key of the statements of a scrape.
+type statementsKey struct{}
+
+var (
+	statementsMu sync.Mutex
+	statements   = &statementSet{byDB: make(map[*sql.DB]map[string]*sql.Stmt)}
+)
+
+// acquireStatements returns the current statements, to release once the scrape is over.
+func acquireStatements() *statementSet {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	statements.users++
+	return statements
+}
+
+// release closes the statements once retired and no scrape uses them.
+func (s *statementSet) release() {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	if s.users--; s.retired && s.users == 0 {
+		s.close(nil)
+	}
+}
+
+// retireStatements makes the next scrapes prepare their statements again, e.g. after a reload,
+// the current ones being closed once the running scrapes are over.
+func retireStatements() {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	retired := statements
+	statements = &statementSet{byDB: make(map[*sql.DB]map[string]*sql.Stmt)}
+	if retired.retired = true; retired.users == 0 {
+		retired.close(nil)
+	}
+}
+
+// prepare returns the statement of query on db, prepared on its first use.
+func (s *statementSet) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	if stmt, ok := s.byDB[db][query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if s.byDB[db] == nil {
+		s.byDB[db] = make(map[string]*sql.Stmt)
+	}
+	s.byDB[db][query] = stmt
+	return stmt, nil
+}
+
+// close closes the statements prepared on db, or on every database when nil. statementsMu must be held.
+func (s *statementSet) close(db *sql.DB) {
+	for prepared, byQuery := range s.byDB {
+		if db != nil && prepared != db {
+			continue
+		}
+		for _, stmt := range byQuery {
+			stmt.Close()
+		}
+		delete(s.byDB, prepared)
+	}
+}
+
+// closeStatements closes the current statements prepared on db, before closing it.
+func closeStatements(db *sql.DB) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	statements.close(db)
+}
+
+// queryTag is the template of --query.tag, nil when the requests are not tagged.
+var queryTag *template.Template
+
+// queryTagFlag parses the template of --query.tag, checking it renders.
+func queryTagFlag() *template.Template {
+	if strings.Compare(strings.TrimSpace(*queryTagFormat), "") == 0 {
+		return nil
+	}
+	tmpl, err := template.New("query.tag").Option("missingkey=error").Parse(*queryTagFormat)
+	if err == nil {
+		err = tmpl.Execute(ioutil.Discard, queryTagData{})
+	}
+	if err != nil {
+		panic(errors.New("Invalid --query.tag: " + err.Error()))
+	}
+	return tmpl
+}
+
+// queryTagData are the variables of --query.tag.
+type queryTagData struct {
+	// Context of the metric, or name of the shared query or dimension
+	Context string
+	// ID of the request of the scrape, empty with --query.prepare for the statements to be reused
+	Scrape string
+}
+
+// tagQuery prefixes the request of a metric with the comment of --query.tag, so that the DBAs
+// can tell its sessions and statements in the monitoring views of DM.
+func tagQuery(ctx context.Context, name string, query string) string {
+	if queryTag == nil {
+		return query
+	}
+	data := queryTagData{Context: name}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && !*prepareQueries {
+		data.Scrape = id
+	}
+	var tag bytes.Buffer
+	if err := queryTag.Execute(&tag, data); err != nil {
+		log.Errorln("Error while rendering --query.tag:", err)
+		return query
+	}
+	// The comment must not end before the tag does
+	return "/* " + strings.Replace(tag.String(), "*/", "* /", -1) + " */ " + query
+}
+
+// Bound on closing the session of a timed out query, which runs apart from the scrape.
+const killTimeout = 5 * time.Second
+
+// killSession closes the session of the exporter still running a query that timed out, as
+// cancelling the context does not always stop the query on the server. conn is the connection
+// of that session, kept out of the pool until it is closed.
+func killSession(db *sql.DB, conn *sql.Conn, session int64) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "CALL SP_CLOSE_SESSION(?)", session); err != nil {
+		log.Errorln("Error while closing session", session, "of a timed out query:", err)
+		return
+	}
+	log.Infoln("Closed session", session, "still running a timed out query")
+}
+
+// inspired by https://kylewbanks.com/blog/query-result-to-map-in-golang
+// Parse SQL result and call parsing function to each row
+func GeneratePrometheusMetrics(ctx context.Context, db *sql.DB, parse func(row map[string]string) error, query string) error {
+
+	// Add a timeout
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	budget, _ := ctx.Value(budgetKey{}).(*scrapeBudget)
+	var rows *sql.Rows
+	var err error
+	var stmt *sql.Stmt
+	// Only the requests of a scrape are prepared, the others run as is
+	if prepared, ok := ctx.Value(statementsKey{}).(*statementSet); ok && *prepareQueries {
+		if stmt, err = prepared.prepare(ctx, db, query); err != nil {
+			return err
+		}
+	}
+	// With --query.kill-on-timeout, the query runs on a connection of its own, so that only
+	// its session is closed when it times out
+	var querier interface {
+		BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	} = db
+	var conn *sql.Conn
+	var session int64
+	if *killOnTimeout {
+		if conn, err = db.Conn(ctx); err != nil {
+			return err
+		}
+		if err = conn.QueryRowContext(ctx, "SELECT SESSID()").Scan(&session); err != nil {
+			conn.Close()
+			return err
+		}
+		querier = conn
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+	}
+	isolation, isolated := isolationLevels[*isolationLevel]
+	// A statement prepared on the pool only runs on a given connection within a transaction
+	if isolated || (conn != nil && stmt != nil) {
+		// Run the query in a transaction, at the configured isolation level if any, rolled back once read
+		var options *sql.TxOptions
+		if isolated {
+			options = &sql.TxOptions{Isolation: isolation}
+		}
+		var tx *sql.Tx
+		tx, err = querier.BeginTx(ctx, options)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if stmt != nil {
+			rows, err = tx.StmtContext(ctx, stmt).QueryContext(ctx)
+		} else {
+			rows, err = tx.QueryContext(ctx, query)
+		}
+	} else if stmt != nil {
+		rows, err = stmt.QueryContext(ctx)
+	} else {
+		rows, err = querier.QueryContext(ctx, query)
+	}
+
+	timedOut := func() error {
+		if conn != nil {
+			// The connection is released once its session is closed
+			go killSession(db, conn, session)
+			conn = nil
+		}
+		return errQueryTimeout
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return timedOut()
+	}
+
+	if err != nil {
+		return err
+	}
+	cols, err := rows.Columns()
+	defer rows.Close()
+
+	for rows.Next() {
+		// Create a slice of interface{}'s to represent each column,
+		// and a second slice to contain pointers to each item in the columns slice.
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		for i, _ := range columns {
+			columnPointers[i] = &columns[i]
+		}
+
+		// Scan the result into the column pointers...
+		if err := rows.Scan(columnPointers...); err != nil {
+			return err
+		}
+
+		// Create our map, and retrieve the value for each column from the pointers slice,
+		// storing it in the map with the name of the column as the key.
+		m := make(map[string]string)
+		size := 0
+		for i, colName := range cols {
+			val := columnPointers[i].(*interface{})
+			value := columnValue(*val)
+			m[strings.ToLower(colName)] = value
+			size += len(value)
+		}
+		if budget != nil {
+			rowsRead := atomic.AddInt64(&budget.rows, 1)
+			bytesRead := atomic.AddInt64(&budget.bytes, int64(size))
+			if (*scrapeMaxRows > 0 && rowsRead > *scrapeMaxRows) || (*scrapeMaxBytes > 0 && bytesRead > *scrapeMaxBytes) {
+				return errBudget
+			}
+		}
+		// Call function to parse row
+		if err := parse(m); err != nil {
+			return err
+		}
+	}
+	// Next also stops when the query is cancelled or times out, the rows read so far
+	// being only part of the result
+	if err := rows.Err(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return timedOut()
+		}
+		return err
+	}
+
+	return nil
+
+}
+
+// columnValue formats the value of a column without exponent, so that numbers used as
+// labels, e.g. ids, read 1000000 instead of 1e+06.
+func columnValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case *big.Float:
+		return v.Text('f', -1)
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case nil:
+		return nullValue
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// DataWatchCollector compares the redo log sequence numbers of a DataWatch
+// primary/standby pair. It implements prometheus.Collector.
+type DataWatchCollector struct {
+	primaryDSN       string
+	standbyDSN       string
+	primary, standby *sql.DB
+	up, curLSN       *prometheus.Desc
+	fileLSN, lsnLag  *prometheus.Desc
+}
+
+// NewDataWatchCollector returns a collector comparing the provided primary and standby DSNs.
+func NewDataWatchCollector(primaryDSN, standbyDSN string) *DataWatchCollector {
+	registerTarget(primaryDSN)
+	registerTarget(standbyDSN)
+	return &DataWatchCollector{
+		primaryDSN: primaryDSN,
+		standbyDSN: standbyDSN,
+		primary:    connect(primaryDSN),
+		standby:    connect(standbyDSN),
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "datawatch", "up"),
+			"Whether the instance of the DataWatch pair could be queried.",
+			[]string{"role"}, nil,
+		),
+		curLSN: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "datawatch", "cur_lsn"),
+			"Current LSN of the instance of the DataWatch pair.",
+			[]string{"role"}, nil,
+		),
+		fileLSN: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "datawatch", "file_lsn"),
+			"LSN flushed to the redo log files of the instance of the DataWatch pair.",
+			[]string{"role"}, nil,
+		),
+		lsnLag: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "datawatch", "lsn_lag"),
+			"Difference between the current LSN of the primary and the standby.",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *DataWatchCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.curLSN
+	ch <- c.fileLSN
+	ch <- c.lsnLag
+}
+
+// Collect implements prometheus.Collector.
+func (c *DataWatchCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch)
+}
+
+// collect queries both instances of the pair with queries bound to ctx.
+func (c *DataWatchCollector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	primaryCur, primaryErr := c.collectLSN(ctx, ch, c.primary, c.primaryDSN, rolePrimary)
+	standbyCur, standbyErr := c.collectLSN(ctx, ch, c.standby, c.standbyDSN, roleStandby)
+	if primaryErr == nil && standbyErr == nil {
+		ch <- prometheus.MustNewConstMetric(c.lsnLag, prometheus.GaugeValue, primaryCur-standbyCur)
+	}
+}
+
+// collectLSN sends the LSNs of one instance of the pair and returns its current LSN.
+func (c *DataWatchCollector) collectLSN(ctx context.Context, ch chan<- prometheus.Metric, db *sql.DB, dsn string, role string) (float64, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var curLSN, fileLSN float64
+	begun := time.Now()
+	err := db.QueryRowContext(ctx, "SELECT CUR_LSN, FILE_LSN FROM V$RLOG").Scan(&curLSN, &fileLSN)
+	updateTarget(dsn, err == nil, begun, err)
+	if err != nil {
+		log.Errorln("Error while getting LSN of DataWatch", role, ":", err)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0, role)
+		return 0, err
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1, role)
+	ch <- prometheus.MustNewConstMetric(c.curLSN, prometheus.GaugeValue, curLSN, role)
+	ch <- prometheus.MustNewConstMetric(c.fileLSN, prometheus.GaugeValue, fileLSN, role)
+	return curLSN, nil
+}
+
+// contextCollector is implemented by collectors whose queries can be bound to a context.
+type contextCollector interface {
+	collect(ctx context.Context, ch chan<- prometheus.Metric)
+}
+
+// requestCollector binds the queries of a collector to the context of an HTTP
+// request, so they are cancelled as soon as the client goes away. It describes
+// nothing, making it an unchecked collector: describing would scrape the database.
+type requestCollector struct {
+	ctx       context.Context
+	collector contextCollector
+}
+
+// Describe implements prometheus.Collector.
+func (c requestCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c requestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collector.collect(c.ctx, ch)
+}
+
+// metricDefinitions returns the merged default and custom metric definitions.
+func metricDefinitions() []metricDefinition {
+	timeout, _ := strconv.Atoi(*queryTimeout)
+	definitions := []metricDefinition{}
+	metrics, _ := currentMetrics()
+	for _, metric := range metrics.Metric {
+		names := make(map[string]string)
+		for name := range metric.MetricsDesc {
+			metricType, ok := metric.MetricsType[strings.ToLower(name)]
+			if !ok {
+				metricType = "gauge"
+			}
+			if len(metric.FieldToAppend) == 0 {
+				names[metric.fqName(name)] = strings.ToLower(metricType)
+			} else {
+				names[metric.generatedName()] = strings.ToLower(metricType)
+			}
+		}
+		definitions = append(definitions, metricDefinition{Metric: metric, Names: names, Timeout: timeout})
+	}
+	return definitions
+}
+
+// Serve the merged default and custom metric definitions as JSON.
+func definitionsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics, files := currentMetrics()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Files      []string           `json:"files"`
+		Metrics    []metricDefinition `json:"metrics"`
+		Dimensions []Dimension        `json:"dimensions"`
+		Queries    []Query            `json:"queries"`
+	}{files, metricDefinitions(), metrics.Dimension, metrics.Query}); err != nil {
+		log.Errorln("Error while encoding metric definitions:", err)
+	}
+}
+
+// recentError is an error of a scrape, kept for the diagnostics.
+type recentError struct {
+	Time    string `json:"time"`
+	Context string `json:"context"`
+	Error   string `json:"error"`
+}
+
+// Number of the last scrape errors kept for the diagnostics.
+const maxRecentErrors = 20
+
+var (
+	recentErrorsMu sync.Mutex
+	recentErrors   []recentError
+	startTime      = time.Now()
+)
+
+// recordError keeps an error of a scrape for the diagnostics, dropping the oldest ones.
+func recordError(context string, err error) {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	recentErrors = append(recentErrors, recentError{Time: time.Now().Format(time.RFC3339), Context: context, Error: err.Error()})
+	if len(recentErrors) > maxRecentErrors {
+		recentErrors = recentErrors[len(recentErrors)-maxRecentErrors:]
+	}
+}
+
+// maskFlag masks the secrets the value of a flag may hold: the passwords of the DSNs, the values of
+// the request template variables, which may be credentials, and anything named like a secret.
+func maskFlag(name, value string) string {
+	switch {
+	case strings.HasSuffix(name, "-dsn"):
+		return maskDSN(value)
+	case strings.Compare(name, "query.vars") == 0:
+		variables := []string{}
+		for _, variable := range strings.Split(value, ",") {
+			if equals := strings.Index(variable, "="); equals >= 0 {
+				variable = variable[:equals+1] + "<masked>"
+			}
+			variables = append(variables, variable)
+		}
+		return strings.Join(variables, ",")
+	case strings.Compare(value, "") == 0:
+		return value
+	}
+	for _, secret := range []string{"password", "secret", "token", "key"} {
+		if strings.Contains(strings.ToLower(name), secret) {
+			return "<masked>"
+		}
+	}
+	return value
+}
+
+// Serve a snapshot of the state of the exporter as JSON, to attach to bug reports: version,
+// flags with secrets masked, metric definitions, targets, recent errors and Go runtime stats.
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	flags := make(map[string]string)
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		flags[flag.Name] = maskFlag(flag.Name, flag.Value.String())
+	}
+	dataSources := make(map[string]string)
+	for _, name := range []string{"DATA_SOURCE_NAME", "DATA_SOURCE_NAME_NEXT", "DATA_SOURCE_NAME_FALLBACK"} {
+		if dsn := os.Getenv(name); strings.Compare(dsn, "") != 0 {
+			dataSources[name] = maskDSN(dsn)
+		}
+	}
+	targetsMu.Lock()
+	statuses := []targetStatus{}
+	for _, target := range targetsOrder {
+		statuses = append(statuses, *targets[target])
+	}
+	targetsMu.Unlock()
+	recentErrorsMu.Lock()
+	errs := append([]recentError{}, recentErrors...)
+	recentErrorsMu.Unlock()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	metrics, files := currentMetrics()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=dmdb_exporter-diagnostics.json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Version       string             `json:"version"`
+		GoVersion     string             `json:"go_version"`
+		Platform      string             `json:"platform"`
+		UptimeSeconds float64            `json:"uptime_seconds"`
+		Flags         map[string]string  `json:"flags"`
+		DataSources   map[string]string  `json:"data_sources"`
+		Files         []string           `json:"files"`
+		Metrics       []metricDefinition `json:"metrics"`
+		Dimensions    []Dimension        `json:"dimensions"`
+		Queries       []Query            `json:"queries"`
+		Targets       []targetStatus     `json:"targets"`
+		RecentErrors  []recentError      `json:"recent_errors"`
+		Goroutines    int                `json:"goroutines"`
+		HeapAlloc     uint64             `json:"heap_alloc_bytes"`
+		Sys           uint64             `json:"sys_bytes"`
+		NumGC         uint32             `json:"num_gc"`
+	}{
+		Version:       Version,
+		GoVersion:     runtime.Version(),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		Flags:         flags,
+		DataSources:   dataSources,
+		Files:         files,
+		Metrics:       metricDefinitions(),
+		Dimensions:    metrics.Dimension,
+		Queries:       metrics.Query,
+		Targets:       statuses,
+		RecentErrors:  errs,
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     memStats.HeapAlloc,
+		Sys:           memStats.Sys,
+		NumGC:         memStats.NumGC,
+	}); err != nil {
+		log.Errorln("Error while encoding diagnostics:", err)
+	}
+}
+
+// sdNotify sends a state notification to systemd when running as a Type=notify unit.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if strings.Compare(socket, "") == 0 {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// runningScrape returns how long the running scrape has lasted, 0 when none is running.
+func (e *Exporter) runningScrape() time.Duration {
+	started := atomic.LoadInt64(&e.scrapeStarted)
+	if started == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, started))
+}
+
+// exporterAlive tells whether the exporter still works: no scrape has been running for more
+// than timeout, e.g. on a deadlock, and the HTTP server listening on address still answers.
+func exporterAlive(exporter *Exporter, address string, timeout time.Duration) error {
+	if running := exporter.runningScrape(); running > timeout {
+		return errors.New("a scrape has been running for " + running.String())
+	}
+	client := http.Client{Timeout: timeout / 4}
+	resp, err := client.Get("http://" + address + statusPath)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(statusPath + " answered " + resp.Status)
+	}
+	return nil
+}
+
+// sdWatchdog pings the systemd watchdog at half the interval it expects, if enabled for this
+// process, as long as alive tells the exporter works given that interval. Otherwise systemd
+// restarts the exporter once the interval is over.
+func sdWatchdog(alive func(timeout time.Duration) error) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); strings.Compare(pid, "") != 0 && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	timeout := time.Duration(usec) * time.Microsecond
+	interval := timeout / 2
+	log.Infoln("Pinging systemd watchdog every", interval)
+	for range time.Tick(interval) {
+		if err := alive(timeout); err != nil {
+			log.Errorln("Not pinging systemd watchdog, the exporter looks hung:", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Errorln("Error while pinging systemd watchdog:", err)
+		}
+	}
+}
+
+// DB gives us some ugly names back. This function cleans things up for Prometheus.
+func cleanName(s string) string {
+	s = strings.Replace(s, " ", "_", -1) // Remove spaces
+	s = strings.Replace(s, "(", "", -1)  // Remove open parenthesis
+	s = strings.Replace(s, ")", "", -1)  // Remove close parenthesis
+	s = strings.Replace(s, "/", "", -1)  // Remove forward slashes
+	s = strings.Replace(s, "*", "", -1)  // Remove asterisks
+	s = strings.ToLower(s)
+	return s
+}
+
+// decodeMetricsFile loads metrics from a TOML file, or from a YAML or JSON file with the
+// same schema when its extension is .yaml, .yml or .json.
+func decodeMetricsFile(path string, metrics *Metrics) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err := yaml.UnmarshalStrict(content, metrics)
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return err
+		}
+		messages := []string{}
+		for _, message := range typeErr.Errors {
+			if match := yamlUnknownField.FindStringSubmatch(message); match != nil {
+				line, _ := strconv.Atoi(match[1])
+				messages = append(messages, unknownKeyMessage(path, line, match[2]))
+			} else if match := yamlLine.FindStringSubmatch(message); match != nil {
+				messages = append(messages, path+":"+match[1]+": "+match[2])
+			} else {
+				messages = append(messages, path+": "+message)
+			}
+		}
+		return errors.New(strings.Join(messages, "\n"))
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(metrics)
+		switch e := err.(type) {
+		case nil:
+			return nil
+		case *json.SyntaxError:
+			return errors.New(path + ":" + strconv.Itoa(lineAt(content, e.Offset)) + ": " + e.Error())
+		case *json.UnmarshalTypeError:
+			return errors.New(path + ":" + strconv.Itoa(lineAt(content, e.Offset)) + ": " + e.Field + " must be of type " + e.Type.String() + ", not " + e.Value)
+		}
+		if match := jsonUnknownField.FindStringSubmatch(err.Error()); match != nil {
+			return errors.New(unknownKeyMessage(path, keyLine(content, `"`+regexp.QuoteMeta(match[1])+`"\s*:`), match[1]))
+		}
+		return err
+	default:
+		metadata, err := toml.Decode(string(content), metrics)
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+		messages := []string{}
+		undecoded := make(map[string]bool)
+		for _, key := range metadata.Undecoded() {
+			undecoded[key.String()] = true
+		}
+	keys:
+		for _, key := range metadata.Undecoded() {
+			// Only report a table, not every key in it
+			for i := 1; i < len(key); i++ {
+				if undecoded[key[:i].String()] {
+					continue keys
+				}
+			}
+			name := regexp.QuoteMeta(key[len(key)-1])
+			line := keyLine(content, `(?m)(?:^|[{,])[ \t]*\[*[ \t]*"?`+name+`"?[ \t]*[=\]]`)
+			messages = append(messages, unknownKeyMessage(path, line, key.String()))
+		}
+		if len(messages) > 0 {
+			return errors.New(strings.Join(messages, "\n"))
+		}
+		return nil
+	}
+}
+
+// Errors of the YAML and JSON decoders about keys matching no field.
+var (
+	yamlUnknownField = regexp.MustCompile(`^line ([0-9]+): field (\S+) not found in type`)
+	yamlLine         = regexp.MustCompile(`^line ([0-9]+): (.*)$`)
+	jsonUnknownField = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+)
+
+// unknownKeyMessage reports a key of a metrics file matching no field, suggesting the
+// closest known key when it looks like a typo.
+func unknownKeyMessage(path string, line int, key string) string {
+	message := path
+	if line > 0 {
+		message += ":" + strconv.Itoa(line)
+	}
+	message += ": unknown key " + key
+	name := key[strings.LastIndex(key, ".")+1:]
+	best, bestDistance := "", 3
+	for _, known := range metricsFileKeys() {
+		if distance := editDistance(strings.ToLower(name), known); distance < bestDistance {
+			best, bestDistance = known, distance
+		}
+	}
+	if strings.Compare(best, "") != 0 {
+		message += ", did you mean " + best + "?"
+	}
+	return message
+}
+
+// metricsFileKeys lists the keys of metrics files, from the fields they are decoded into.
+func metricsFileKeys() []string {
+	keys := []string{"metric", "dimension", "query", "vars", "sanitize"}
+	for _, value := range []interface{}{Metric{}, Dimension{}, Query{}, Dependency{}, Sanitize{}, Replacement{}} {
+		t := reflect.TypeOf(value)
+		for i := 0; i < t.NumField(); i++ {
+			if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; strings.Compare(name, "") != 0 {
+				keys = append(keys, name)
+			}
+		}
+	}
+	return keys
+}
+
+// editDistance is the number of characters to insert, delete or replace to turn a into b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// lineAt returns the line of content at offset.
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+// keyLine returns the line of the first match of pattern in content, 0 if none.
+func keyLine(content []byte, pattern string) int {
+	location := regexp.MustCompile(pattern).FindIndex(content)
+	if location == nil {
+		return 0
+	}
+	return lineAt(content, int64(location[0]))
+}
+
+// Extensions of the files loaded from a directory of custom metrics.
+var metricsFileExtensions = map[string]bool{".toml": true, ".yaml": true, ".yml": true, ".json": true}
+
+// customMetricsFiles expands the comma-separated list of --custom.metrics into files.
+// Each entry can be a file, a glob pattern or a directory, from which all TOML, YAML
+// and JSON files are loaded.
+func customMetricsFiles(list string) []string {
+	files := []string{}
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if strings.Compare(pattern, "") == 0 {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			panic(errors.New("Invalid custom metrics pattern " + pattern + ": " + err.Error()))
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			panic(errors.New("Custom metrics file " + pattern + " does not exist"))
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				panic(err)
+			}
+			if !info.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				panic(err)
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && metricsFileExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+					files = append(files, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	return files
+}
+
+// fqName is the fully-qualified name of a metric of m: <namespace>_<subsystem>_<name>, dmdb
+// and the context unless the metric sets its own namespace or subsystem, possibly empty.
+func (m Metric) fqName(name string) string {
+	metricNamespace, subsystem := namespace, m.Context
+	if m.Namespace != nil {
+		metricNamespace = *m.Namespace
+	}
+	if m.Subsystem != nil {
+		subsystem = *m.Subsystem
+	}
+	return prometheus.BuildFQName(metricNamespace, subsystem, m.unitName(name))
+}
+
+// limitKey identifies a metric definition in the cardinality limits file: its first metric
+// name, along with its range of versions when restricted to some, as several definitions
+// can share a context.
+func (m Metric) limitKey() string {
+	names := []string{}
+	for name := range m.MetricsDesc {
+		names = append(names, m.fqName(name))
+	}
+	sort.Strings(names)
+	key := m.Context
+	if len(names) > 0 {
+		key = names[0]
+	}
+	if strings.Compare(m.MinVersion+m.MaxVersion, "") != 0 {
+		key += " " + m.MinVersion + "-" + m.MaxVersion
+	}
+	return key
+}
+
+// unitName adds the suffix of its unit to the name of a column, and _total to counters.
+func (m Metric) unitName(column string) string {
+	unit, ok := m.Unit[column]
+	if !ok {
+		return column
+	}
+	name := strings.TrimSuffix(column, "_total")
+	if !strings.HasSuffix(name, "_"+unit) {
+		name += "_" + unit
+	}
+	if GetMetricType(column, m.MetricsType) == prometheus.CounterValue {
+		name += "_total"
+	}
+	return name
+}
+
+// definitionKey identifies the definition of a fully-qualified metric name, which can be
+// defined once for each range of versions.
+func (m Metric) definitionKey(fqName string) string {
+	return fqName + " " + m.MinVersion + "-" + m.MaxVersion
+}
+
+// generatedName is the pattern of the names a metric with fieldtoappend exports, such as
+// dmdb_sysstat_<name>.
+func (m Metric) generatedName() string {
+	return m.fqName("<" + strings.Join(m.FieldToAppend, ">_<") + ">")
+}
+
+// contextUse is a file using a context for a range of versions.
+type contextUse struct {
+	file       string
+	minVersion string
+	maxVersion string
+}
+
+// versionsOverlap tells whether two ranges of versions, empty bounds being open, share
+// a version.
+func versionsOverlap(aMin, aMax, bMin, bMax string) bool {
+	if strings.Compare(aMax, "") != 0 && strings.Compare(bMin, "") != 0 && !atMost(bMin, aMax) {
+		return false
+	}
+	if strings.Compare(bMax, "") != 0 && strings.Compare(aMin, "") != 0 && !atMost(aMin, bMax) {
+		return false
+	}
+	return true
+}
+
+// checkGeneratedNames warns when a name defined in a file can be exported by a metric
+// with fieldtoappend of another file for the same versions, as the values of its fields
+// are only known at scrape time.
+func checkGeneratedNames(metric *Metric, name string, file string, definedIn map[string]string) {
+	for key, previous := range definedIn {
+		if strings.Compare(previous, file) == 0 {
+			continue
+		}
+		i := strings.LastIndex(key, " ")
+		versions := strings.SplitN(key[i+1:], "-", 2)
+		if !versionsOverlap(metric.MinVersion, metric.MaxVersion, versions[0], versions[1]) {
+			continue
+		}
+		other := key[:i]
+		prefix, otherPrefix := name, other
+		if j := strings.Index(name, "<"); j >= 0 {
+			prefix = name[:j]
+		}
+		if j := strings.Index(other, "<"); j >= 0 {
+			otherPrefix = other[:j]
+		}
+		if strings.Compare(prefix, name) == 0 && strings.Compare(otherPrefix, other) == 0 {
+			continue
+		}
+		if strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix) {
+			log.Warnln("Metric", name, "of", file, "may collide with metric", other, "of", previous)
+		}
+	}
+}
+
+// configProblems are the problems found in the metrics files, reported together rather than
+// one at a time, e.g. by check-config.
+type configProblems []string
+
+func (p configProblems) Error() string {
+	return strings.Join(p, "\n")
+}
+
+// collectProblems runs step, adding the problems it panics with to problems.
+func collectProblems(problems *[]string, step func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if found, ok := r.(configProblems); ok {
+				*problems = append(*problems, found...)
+			} else {
+				*problems = append(*problems, fmt.Sprint(r))
+			}
+		}
+	}()
+	step()
+}
+
+// loadMetricsFile merges the metrics and dimensions of a file into metricsToScrap.
+// definedIn records the file defining each metric name, and contextIn the files using
+// each context, so that a metric defined twice or a context used by two files for the
+// same versions is reported along with both files. Metrics with override set replace the
+// metrics of the same context loaded from previous files.
+func loadMetricsFile(file string, definedIn map[string]string, contextIn map[string][]contextUse) {
+	loaded := Metrics{}
+	if err := decodeMetricsFile(file, &loaded); err != nil {
+		panic(errors.New("Error while loading " + file + ":\n" + err.Error()))
+	}
+	overridden := make(map[string]bool)
+	for _, metric := range loaded.Metric {
+		if metric.Override {
+			overridden[metric.Context] = true
+		}
+	}
+	if len(overridden) > 0 {
+		kept := []Metric{}
+		for _, metric := range metricsToScrap.Metric {
+			if !overridden[metric.Context] {
+				kept = append(kept, metric)
+				continue
+			}
+			log.Infoln("Metric", metric.Context, "overridden by", file)
+			delete(contextIn, metric.Context)
+			if len(metric.FieldToAppend) > 0 {
+				delete(definedIn, metric.definitionKey(metric.generatedName()))
+			}
+			for name := range metric.MetricsDesc {
+				delete(definedIn, metric.definitionKey(metric.fqName(name)))
+			}
+		}
+		metricsToScrap.Metric = kept
+	}
+	vars := templateVars(loaded.Vars)
+	problems := []string{}
+	check := func(step func()) { collectProblems(&problems, step) }
+	for i := range loaded.Metric {
+		metric := &loaded.Metric[i]
+		metric.module = moduleName(file)
+		if strings.Compare(metric.RequestFile, "") != 0 {
+			check(func() { metric.Request = readRequestFile(metric, file) })
+		}
+		if metric.Sanitize == nil {
+			metric.Sanitize = loaded.Sanitize
+		} else {
+			for _, column := range metric.Sanitize.Labels {
+				if !hasLabel(metric.Labels, column) {
+					problems = append(problems, "Sanitized column "+column+" of metric "+metric.Context+" is not one of its labels")
+				}
+			}
+		}
+		check(func() { metric.Request = expandRequest(metric.Request, vars, file) })
+		check(func() { metric.Condition = expandEnv(metric.Condition, file) })
+		for j := range metric.Labels {
+			j := j
+			check(func() { metric.Labels[j] = expandEnv(metric.Labels[j], file) })
+		}
+		// Several metrics of a file can share a context, but the errors and durations of a
+		// context would merge the metrics of unrelated files scraped for the same version
+		for _, previous := range contextIn[metric.Context] {
+			if strings.Compare(previous.file, file) != 0 &&
+				versionsOverlap(previous.minVersion, previous.maxVersion, metric.MinVersion, metric.MaxVersion) {
+				problems = append(problems, "Context "+metric.Context+" is used in both "+previous.file+" and "+file+
+					", set override = true to replace its metrics or rename it")
+			}
+		}
+		contextIn[metric.Context] = append(contextIn[metric.Context], contextUse{file, metric.MinVersion, metric.MaxVersion})
+		// The names of a metric with fieldtoappend come from its rows, only their pattern is known
+		names := []string{}
+		if len(metric.FieldToAppend) > 0 {
+			names = append(names, metric.generatedName())
+		} else {
+			for name := range metric.MetricsDesc {
+				names = append(names, metric.fqName(name))
+			}
+		}
+		for _, fqName := range names {
+			if previous, ok := definedIn[metric.definitionKey(fqName)]; ok {
+				problems = append(problems, "Metric "+fqName+" is defined in both "+previous+" and "+file+
+					", set override = true to replace the metrics of context "+metric.Context)
+				continue
+			}
+			checkGeneratedNames(metric, fqName, file, definedIn)
+			definedIn[metric.definitionKey(fqName)] = file
+		}
+	}
+	// The default sanitization only applies to the labels of the metrics without their own
+	if loaded.Sanitize != nil {
+		for _, column := range loaded.Sanitize.Labels {
+			used := false
+			for _, metric := range loaded.Metric {
+				used = used || (metric.Sanitize == loaded.Sanitize && hasLabel(metric.Labels, column))
+			}
+			if !used {
+				problems = append(problems, "Sanitized column "+column+" of "+file+" is not a label of the metrics without their own sanitize")
+			}
+		}
+	}
+	for i := range loaded.Dimension {
+		dimension := &loaded.Dimension[i]
+		check(func() { dimension.Request = expandRequest(dimension.Request, vars, file) })
+	}
+	for i := range loaded.Query {
+		query := &loaded.Query[i]
+		check(func() { query.Request = expandRequest(query.Request, vars, file) })
+	}
+	problems = append(problems, checkMetricsFile(file, loaded)...)
+	if len(problems) > 0 {
+		panic(configProblems(problems))
+	}
+	metricsToScrap.Metric = append(metricsToScrap.Metric, loaded.Metric...)
+	metricsToScrap.Dimension = append(metricsToScrap.Dimension, loaded.Dimension...)
+	metricsToScrap.Query = append(metricsToScrap.Query, loaded.Query...)
+	metricsFiles = append(metricsFiles, file)
+}
+
+// Requests selecting all the columns of a table, whose columns can not be checked.
+var selectAll = regexp.MustCompile(`(?i)\bselect\s+(distinct\s+)?(\w+\.)?\*`)
+
+// checkMetricsFile reports the metrics of a file missing their context, request or
+// metricsdesc, their invalid types, and the columns they use that do not appear in their
+// request, by index.
+func checkMetricsFile(file string, loaded Metrics) []string {
+	requests := make(map[string]string)
+	for _, query := range loaded.Query {
+		requests[query.Name] = query.Request
+	}
+	problems := []string{}
+	for i, metric := range loaded.Metric {
+		where := fmt.Sprintf("%s: metric[%d] (context %q)", file, i, metric.Context)
+		request := metric.Request
+		if strings.Compare(metric.QueryRef, "") != 0 {
+			request = requests[metric.QueryRef]
+		}
+		if strings.Compare(metric.Context, "") == 0 {
+			problems = append(problems, where+": missing context")
+		}
+		if strings.Compare(metric.Request, "") == 0 && strings.Compare(metric.QueryRef, "") == 0 {
+			problems = append(problems, where+": missing request")
+		}
+		if len(metric.MetricsDesc) == 0 {
+			problems = append(problems, where+": missing metricsdesc")
+		}
+		typed := []string{}
+		for column := range metric.MetricsType {
+			typed = append(typed, column)
+		}
+		sort.Strings(typed)
+		for _, column := range typed {
+			switch strings.ToLower(metric.MetricsType[column]) {
+			case "gauge", "counter", metricTypeHistogram, metricTypeSummary, metricTypeInfo:
+			default:
+				problems = append(problems, where+": invalid type "+metric.MetricsType[column]+" of column "+column+
+					", must be gauge, counter, histogram, summary or info")
+			}
+		}
+		// Columns can only be checked when the request names them
+		if strings.Compare(request, "") == 0 || selectAll.MatchString(request) {
+			continue
+		}
+		columns := append([]string{}, metric.Labels...)
+		columns = append(columns, metric.FieldToAppend...)
+		for column := range metric.MetricsDesc {
+			switch strings.ToLower(metric.MetricsType[strings.ToLower(column)]) {
+			case metricTypeHistogram, metricTypeSummary:
+				// Read from count and sum columns, possibly prefixed with the name of the metric
+				columns = append(columns, column+"_count|count")
+			case metricTypeInfo:
+				columns = append(columns, metric.InfoLabels[column]...)
+			default:
+				columns = append(columns, column)
+			}
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			alternatives := strings.Split(column, "|")
+			for j := range alternatives {
+				alternatives[j] = regexp.QuoteMeta(alternatives[j])
+			}
+			if !regexp.MustCompile(`(?i)\b(` + strings.Join(alternatives, "|") + `)\b`).MatchString(request) {
+				problems = append(problems, where+": column "+strings.Join(strings.Split(column, "|"), " or ")+" does not appear in the request")
+			}
+		}
+	}
+	return problems
+}
+
+// readRequestFile reads the request of a metric from its requestfile, relative to the
+// metrics file defining it.
+func readRequestFile(metric *Metric, file string) string {
+	if strings.Compare(metric.Request, "") != 0 {
+		panic(errors.New("Metric " + metric.Context + " in " + file + " sets both request and requestfile"))
+	}
+	path := metric.RequestFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(file), path)
+	}
+	metric.requestPath = path
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(errors.New("Error while reading the request of metric " + metric.Context + ": " + err.Error()))
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// Environment variables referenced in metric files. Only the ${VAR} form is expanded,
+// as $ is part of the name of DM views such as V$SESSIONS.
+var envVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} references of a value of a metric file with the
+// environment variables they name, which must be set.
+func expandEnv(value string, file string) string {
+	return envVariable.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envVariable.FindStringSubmatch(reference)[1]
+		variable, ok := os.LookupEnv(name)
+		if !ok {
+			panic(errors.New("Environment variable " + name + " used in " + file + " is not set"))
+		}
+		return variable
+	})
+}
+
+// templateVars returns the variables of the request templates of a file: its vars,
+// overridden by the ones of --query.vars.
+func templateVars(fileVars map[string]string) map[string]string {
+	vars := make(map[string]string)
+	for name, value := range fileVars {
+		vars[name] = value
+	}
+	for _, variable := range strings.Split(*queryVars, ",") {
+		if strings.Compare(strings.TrimSpace(variable), "") == 0 {
+			continue
+		}
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || strings.Compare(strings.TrimSpace(parts[0]), "") == 0 {
+			panic(errors.New("Invalid variable " + variable + " in --query.vars, must be name=value"))
+		}
+		vars[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return vars
+}
+
+// expandRequest renders a request of a metric file, then expands its environment variables,
+// so that their values are used as is, even when they contain {{.
+func expandRequest(request string, vars map[string]string, file string) string {
+	return expandEnv(renderRequest(request, vars, file), file)
+}
+
+// renderRequest renders a request of a metric file as a Go template, e.g.
+// "SELECT ... WHERE OWNER = '{{.Schema}}'", with the variables of the file.
+func renderRequest(request string, vars map[string]string, file string) string {
+	if !strings.Contains(request, "{{") {
+		return request
+	}
+	tmpl, err := template.New(file).Option("missingkey=error").Parse(request)
+	if err != nil {
+		panic(errors.New("Invalid request template in " + file + ": " + err.Error()))
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, vars); err != nil {
+		panic(errors.New("Error while rendering a request of " + file + ": " + err.Error()))
+	}
+	return rendered.String()
+}
+
+func main() {
+	log.AddFlags(kingpin.CommandLine)
+	kingpin.Version("dmdb_exporter " + Version)
+	kingpin.HelpFlag.Short('h')
+	command := kingpin.Parse()
+
+	// Platform specific commands, e.g. managing the Windows service
+	if serviceCommand(command) {
+		return
+	}
+	if diffCommand(command) {
+		return
+	}
+	if checkConfigCommand(command) {
+		return
+	}
+	run()
+}
+
+// maintenanceWindowsFlag parses the windows of --maintenance.windows.
+func maintenanceWindowsFlag() []timeWindow {
+	windows := []timeWindow{}
+	for _, window := range strings.Split(*maintenanceWindows, ";") {
+		if strings.Compare(strings.TrimSpace(window), "") == 0 {
+			continue
+		}
+		parsed, err := parseTimeWindow(strings.TrimSpace(window))
+		if err != nil {
+			panic(errors.New("Invalid maintenance window: " + err.Error()))
+		}
+		windows = append(windows, parsed)
+	}
+	return windows
+}
+
+// parameterNamesFlag parses the DM parameters of --parameters.names.
+func parameterNamesFlag() []string {
+	names := []string{}
+	for _, name := range strings.Split(*parametersNames, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if strings.Compare(name, "") == 0 {
+			continue
+		}
+		if !parameterName.MatchString(name) {
+			panic(errors.New("Invalid DM parameter name: " + name))
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// hasModule tells whether metrics were loaded from the module.
+func hasModule(module string) bool {
+	metrics, _ := currentMetrics()
+	for _, metric := range metrics.Metric {
+		if strings.Compare(metric.module, module) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadMetrics loads the metrics files again and replaces the metrics to scrape, or keeps
+// them when the files are invalid.
+func reloadMetrics() (err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	previous, previousFiles := metricsToScrap, metricsFiles
+	defer func() {
+		if r := recover(); r != nil {
+			metricsToScrap, metricsFiles = previous, previousFiles
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	metricsToScrap, metricsFiles = Metrics{}, nil
+	loadMetrics()
+	return nil
+}
+
+// metricsFilesState tells when the metrics files, the request files they use or the limits
+// file of --cardinality.enforce change: files added or removed from the custom metrics
+// directories, or modified. Files are compared by content, as a Kubernetes ConfigMap is
+// updated by swapping a symbolic link, which can leave the size and time of the files as they were.
+func metricsFilesState() string {
+	files := []string{*defaultFileMetrics}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				files = append(files, fmt.Sprint(r))
+			}
+		}()
+		if strings.Compare(*customMetrics, "") != 0 {
+			files = append(files, customMetricsFiles(*customMetrics)...)
+		}
+	}()
+	metrics, _ := currentMetrics()
+	for _, metric := range metrics.Metric {
+		if strings.Compare(metric.requestPath, "") != 0 {
+			files = append(files, metric.requestPath)
+		}
+	}
+	if *cardinalityEnforce {
+		files = append(files, *cardinalityFile)
+	}
+	state := ""
+	for _, file := range files {
+		state += file
+		if content, err := ioutil.ReadFile(file); err == nil {
+			sum := sha256.Sum256(content)
+			state += " " + hex.EncodeToString(sum[:])
+		}
+		state += "\n"
+	}
+	return state
+}
+
+// watchMetricsFiles reloads the metrics files when they change, checking them every interval.
+func watchMetricsFiles(interval time.Duration) {
+	state := metricsFilesState()
+	for range time.Tick(interval) {
+		current := metricsFilesState()
+		if strings.Compare(current, state) == 0 {
+			continue
+		}
+		state = current
+		if err := reloadMetrics(); err != nil {
+			log.Errorln("Error while reloading the metrics files, keeping the previous metrics:", err)
+			reloadSuccessful.Set(0)
+			continue
+		}
+		// The requests files may have changed with the metrics files
+		state = metricsFilesState()
+		retireStatements()
+		pruneQueryStats()
+		log.Infoln("Reloaded the metrics files")
+		reloadSuccessful.Set(1)
+		reloadSuccessTime.SetToCurrentTime()
+	}
+}
+
+// loadMetrics loads the default and custom metrics files into metricsToScrap and
+// validates them. It panics on the first file with problems.
+func loadMetrics() {
+	// Load default metrics
+	definedIn := make(map[string]string)
+	contextIn := make(map[string][]contextUse)
+	loadMetricsFile(*defaultFileMetrics, definedIn, contextIn)
+	log.Infoln("Successfully loaded default metrics from: " + *defaultFileMetrics)
+
+	// If custom metrics, load them
+	if strings.Compare(*customMetrics, "") != 0 {
+		for _, file := range customMetricsFiles(*customMetrics) {
+			loadMetricsFile(file, definedIn, contextIn)
+			log.Infoln("Successfully loaded custom metrics from: " + file)
+		}
+	} else {
+		log.Infoln("No custom metrics defined.")
+	}
+	validateMetrics()
+}
+
+var groupName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// validateMetrics drops the excluded and disabled metrics of metricsToScrap and checks
+// the others. It panics with all the problems found.
+func validateMetrics() {
+	problems := []string{}
+	excluded := make(map[string]bool)
+	for _, name := range strings.Split(*excludeMetrics, ",") {
+		if name = strings.TrimSpace(name); strings.Compare(name, "") != 0 {
+			excluded[name] = true
+		}
+	}
+	excludedGroups := make(map[string]bool)
+	for _, group := range strings.Split(*excludeGroups, ",") {
+		if group = strings.TrimSpace(group); strings.Compare(group, "") != 0 {
+			excludedGroups[group] = true
+		}
+	}
+	for group, collect := range collectGroups {
+		if !*collect {
+			excludedGroups[group] = true
+		}
+	}
+	limits := cardinalityLimitsFlag()
+	enabledMetrics := []Metric{}
+	for _, metric := range metricsToScrap.Metric {
+		if strings.Compare(metric.Group, "") != 0 && !groupName.MatchString(metric.Group) {
+			problems = append(problems, "Invalid group "+metric.Group+" of metric "+metric.Context+", expected lowercase letters, digits and _")
+		}
+		if excluded[metric.Context] || (metric.Enabled != nil && !*metric.Enabled) {
+			log.Infoln("Metric", metric.Context, "is disabled")
+			continue
+		}
+		if excludedGroups[metric.Group] {
+			log.Infoln("Metric", metric.Context, "of group", metric.Group, "is disabled")
+			continue
+		}
+		if limit, ok := limits[metric.limitKey()]; ok && metric.MaxSeries == 0 {
+			metric.MaxSeries = limit
+		}
+		enabledMetrics = append(enabledMetrics, metric)
+	}
+	metricsToScrap.Metric = enabledMetrics
+
+	knownDimensions := make(map[string]bool)
+	for _, dimension := range metricsToScrap.Dimension {
+		if strings.Compare(dimension.Name, "") == 0 || strings.Compare(dimension.Key, "") == 0 || strings.Compare(dimension.Request, "") == 0 {
+			problems = append(problems, "Dimension "+dimension.Name+" must define name, key and request")
+		}
+		if knownDimensions[dimension.Name] {
+			problems = append(problems, "Dimension "+dimension.Name+" is defined more than once")
+		}
+		knownDimensions[dimension.Name] = true
+	}
+	knownQueries := make(map[string]bool)
+	for _, query := range metricsToScrap.Query {
+		if strings.Compare(query.Name, "") == 0 || strings.Compare(query.Request, "") == 0 {
+			problems = append(problems, "Query "+query.Name+" must define name and request")
+		}
+		if knownQueries[query.Name] {
+			problems = append(problems, "Query "+query.Name+" is defined more than once")
+		}
+		knownQueries[query.Name] = true
+	}
+	for i := range metricsToScrap.Metric {
+		metric := &metricsToScrap.Metric[i]
+		for _, name := range metric.Dimensions {
+			if !knownDimensions[name] {
+				problems = append(problems, "Metric "+metric.Context+" uses unknown dimension "+name)
+			}
+		}
+		if strings.Compare(metric.QueryRef, "") != 0 {
+			if !knownQueries[metric.QueryRef] {
+				problems = append(problems, "Metric "+metric.Context+" uses unknown query "+metric.QueryRef)
+			}
+			if strings.Compare(metric.Request, "") != 0 {
+				problems = append(problems, "Metric "+metric.Context+" sets both request and queryref")
+			}
+		}
+		for column, columnType := range metric.ColumnTypes {
+			switch strings.ToLower(columnType) {
+			case columnNumber, columnString:
+			default:
+				problems = append(problems, "Invalid type "+columnType+" for column "+column+" of metric "+metric.Context+", must be number or string")
+			}
+		}
+		for _, part := range []*string{metric.Namespace, metric.Subsystem} {
+			if part != nil && strings.Compare(*part, "") != 0 && !model.IsValidMetricName(model.LabelValue(*part)) {
+				problems = append(problems, "Invalid namespace or subsystem "+*part+" for metric "+metric.Context)
+			}
+		}
+		for name := range metric.ConstLabels {
+			if !model.LabelName(name).IsValid() {
+				problems = append(problems, "Invalid constant label "+name+" for metric "+metric.Context)
+			}
+			if hasLabel(metric.Labels, name) {
+				problems = append(problems, "Constant label "+name+" of metric "+metric.Context+" is also one of its labels")
+			}
+		}
+		for name, metricType := range metric.MetricsType {
+			if strings.EqualFold(metricType, metricTypeInfo) && len(metric.InfoLabels[name]) == 0 {
+				problems = append(problems, "Info metric "+name+" of metric "+metric.Context+" has no infolabels")
+			}
+		}
+		for name, columns := range metric.InfoLabels {
+			for _, column := range columns {
+				if !model.LabelName(column).IsValid() {
+					problems = append(problems, "Invalid info label "+column+" for metric "+metric.Context)
+				}
+				if hasLabel(metric.Labels, column) || metric.ConstLabels[column] != "" {
+					problems = append(problems, "Info label "+column+" of "+name+" of metric "+metric.Context+" is also one of its labels")
+				}
+			}
+		}
+		metric.scaleFactors = make(map[string]float64)
+		for column, scale := range metric.Scale {
+			factor, err := strconv.ParseFloat(strings.TrimSpace(scale), 64)
+			if err != nil {
+				problems = append(problems, "Invalid scale "+scale+" for column "+column+" of metric "+metric.Context)
+			}
+			metric.scaleFactors[column] = factor
+		}
+		for column, unit := range metric.Unit {
+			help, ok := metric.MetricsDesc[column]
+			switch {
+			case !ok:
+				problems = append(problems, "Unit "+unit+" of metric "+metric.Context+" is for unknown column "+column)
+			case !baseUnits[unit]:
+				problems = append(problems, "Invalid unit "+unit+" for column "+column+" of metric "+metric.Context+
+					", must be a base unit such as seconds, bytes or ratio")
+			case strings.Compare(strings.TrimSpace(help), "") == 0:
+				problems = append(problems, "Column "+column+" of metric "+metric.Context+" has a unit but no help text")
+			case nonBaseUnits.MatchString(strings.TrimSuffix(column, "_total")):
+				problems = append(problems, "Column "+column+" of metric "+metric.Context+" is named after another unit than "+
+					unit+", convert it with scale and rename it")
+			case strings.HasSuffix(column, "_total") && GetMetricType(column, metric.MetricsType) != prometheus.CounterValue:
+				problems = append(problems, "Column "+column+" of metric "+metric.Context+" ends with _total but is not a counter")
+			}
+		}
+		for _, column := range metric.Fingerprints {
+			if !hasLabel(metric.Labels, column) {
+				problems = append(problems, "Fingerprint column "+column+" of metric "+metric.Context+" is not one of its labels")
+			}
+		}
+		if metric.Sanitize != nil {
+			for j := range metric.Sanitize.Replace {
+				replacement := &metric.Sanitize.Replace[j]
+				compiled, err := regexp.Compile(replacement.Pattern)
+				if err != nil {
+					problems = append(problems, "Invalid sanitize pattern "+replacement.Pattern+" for metric "+metric.Context+": "+err.Error())
+				}
+				replacement.regexp = compiled
+			}
+			if metric.Sanitize.MaxLength < 0 {
+				problems = append(problems, "Invalid sanitize maxlength "+strconv.Itoa(metric.Sanitize.MaxLength)+" for metric "+metric.Context+", must be positive")
+			}
+		}
+		for _, version := range []string{metric.MinVersion, metric.MaxVersion} {
+			if strings.Compare(version, "") != 0 && !versionNumber.MatchString(version) {
+				problems = append(problems, "Invalid version "+version+" for metric "+metric.Context+", must be like 8 or 7.6")
+			}
+		}
+		if metric.MaxRows < 0 {
+			problems = append(problems, "Invalid maxrows "+strconv.FormatInt(metric.MaxRows, 10)+" for metric "+metric.Context+", must be positive")
+		}
+		switch strings.ToLower(metric.MaxRowsAction) {
+		case "", maxRowsError, maxRowsTruncate:
+		default:
+			problems = append(problems, "Invalid maxrows action "+metric.MaxRowsAction+" for metric "+metric.Context+", must be error or truncate")
+		}
+		switch strings.ToLower(metric.Tier) {
+		case "", tierCritical, tierNormal, tierSlow:
+		default:
+			problems = append(problems, "Invalid tier "+metric.Tier+" for metric "+metric.Context+", must be critical, normal or slow")
+		}
+		if metric.MaxSeries < 0 {
+			problems = append(problems, "Invalid maxseries "+strconv.FormatInt(metric.MaxSeries, 10)+" for metric "+metric.Context+", must be positive")
+		}
+		if metric.Retries < 0 {
+			problems = append(problems, "Invalid retries "+strconv.FormatInt(metric.Retries, 10)+" for metric "+metric.Context+", must be positive")
+		}
+		metric.retryDelay = defaultRetryDelay
+		if strings.Compare(metric.RetryDelay, "") != 0 {
+			delay, err := time.ParseDuration(metric.RetryDelay)
+			if err != nil || delay <= 0 {
+				problems = append(problems, "Invalid retrydelay "+metric.RetryDelay+" for metric "+metric.Context+", must be a positive duration like 500ms")
+			}
+			metric.retryDelay = delay
+		}
+		switch strings.ToLower(metric.NullPolicy) {
+		case "", nullSkip, nullZero, nullNaN:
+		default:
+			problems = append(problems, "Invalid null policy "+metric.NullPolicy+" for metric "+metric.Context+", must be skip, zero or nan")
+		}
+		for column, format := range metric.Format {
+			switch strings.ToLower(format) {
+			case formatDuration, formatTimestamp:
+			default:
+				problems = append(problems, "Invalid format "+format+" for column "+column+" of metric "+metric.Context+", must be duration or timestamp")
+			}
+		}
+		if strings.Compare(metric.TimeZone, "") != 0 {
+			location, err := time.LoadLocation(metric.TimeZone)
+			if err != nil {
+				problems = append(problems, "Invalid timezone "+metric.TimeZone+" for metric "+metric.Context+": "+err.Error())
+			}
+			metric.timeLocation = location
+		}
+		for column, mapping := range metric.ValueMap {
+			for text, number := range mapping {
+				if _, err := strconv.ParseFloat(number, 64); err != nil {
+					problems = append(problems, "Invalid value "+number+" for "+text+" in the valuemap of column "+column+" of metric "+metric.Context)
+				}
+			}
+		}
+		for column, alias := range metric.Aliases {
+			if _, ok := metric.MetricsDesc[column]; !ok {
+				problems = append(problems, "Alias "+alias+" of metric "+metric.Context+" is for unknown column "+column)
+			}
+			if !model.IsValidMetricName(model.LabelValue(alias)) {
+				problems = append(problems, "Invalid alias "+alias+" for metric "+metric.Context)
+			}
+			if len(metric.FieldToAppend) > 0 {
+				problems = append(problems, "Metric "+metric.Context+" can not have aliases as its names come from fieldtoappend")
+			}
+		}
+		switch strings.ToLower(metric.ConversionLog) {
+		case "", conversionLogError, conversionLogDebug:
+		default:
+			problems = append(problems, "Invalid conversion log level "+metric.ConversionLog+" for metric "+metric.Context+", must be error or debug")
+		}
+		switch strings.ToLower(metric.Role) {
+		case "", rolePrimary, roleStandby, roleAny:
+		default:
+			problems = append(problems, "Invalid role "+metric.Role+" for metric "+metric.Context+", must be primary, standby or any")
+		}
+		for _, window := range metric.Schedule {
+			parsed, err := parseTimeWindow(window)
+			if err != nil {
+				problems = append(problems, "Invalid schedule for metric "+metric.Context+": "+err.Error())
+			}
+			metric.scheduleWindows = append(metric.scheduleWindows, parsed)
+		}
+		for _, window := range metric.Blackout {
+			parsed, err := parseTimeWindow(window)
+			if err != nil {
+				problems = append(problems, "Invalid blackout for metric "+metric.Context+": "+err.Error())
+			}
+			metric.blackoutWindows = append(metric.blackoutWindows, parsed)
+		}
+		if strings.Compare(metric.FreshnessColumn, "") != 0 && metric.MaxAge <= 0 {
+			problems = append(problems, "Metric "+metric.Context+" has a freshness column but no positive maxage")
+		}
+	}
+	if err := checkDependencies(metricsToScrap.Metric); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		panic(configProblems(problems))
+	}
+}
+
+// stopExporter is closed to stop run like SIGTERM does, e.g. by the Windows service.
+var stopExporter = make(chan struct{})
+
+// run loads the metric files and serves the exporter until it fails.
+func run() {
+	log.Infoln("Starting dmdb_exporter " + Version)
+	dsn := os.Getenv("DATA_SOURCE_NAME")
+	loadMetrics()
+	queryTag = queryTagFlag()
+	// During a password rotation, try the next credentials first and fall back to the current ones
+	nextDSN := os.Getenv("DATA_SOURCE_NAME_NEXT")
+	var exporter *Exporter
+	if strings.Compare(nextDSN, "") != 0 {
+		log.Infoln("Using the next credentials, falling back to the current ones")
+		exporter = NewExporter(nextDSN)
+		exporter.otherDSN = dsn
+	} else {
+		exporter = NewExporter(dsn)
+	}
+	if fallbackDSN := os.Getenv("DATA_SOURCE_NAME_FALLBACK"); strings.Compare(fallbackDSN, "") != 0 {
+		log.Infoln("Falling back to", maskDSN(fallbackDSN), "when the database is down")
+		exporter.fallbackDSN = fallbackDSN
+		exporter.fallbackDB = connect(fallbackDSN)
+	}
+	// The credentials in use, the targets being named after their user
+	registerTarget(exporter.dsn)
+	var store *stateStore
+	if strings.Compare(*storagePath, "") != 0 {
+		var err error
+		if store, err = openStateStore(*storagePath); err != nil {
+			panic(errors.New("Invalid storage path: " + err.Error()))
+		}
+		log.Infoln("Keeping the state of the exporter in", *storagePath)
+	}
+	exporter.maintenance.store = store
+	exporter.maintenance.restore()
+	exporter.maintenance.windows = maintenanceWindowsFlag()
+	parameterNames = parameterNamesFlag()
+	collectors := []contextCollector{exporter}
+	dataWatch := strings.Compare(*dataWatchPrimary, "") != 0 && strings.Compare(*dataWatchStandby, "") != 0
+	if dataWatch {
+		log.Infoln("Comparing DataWatch primary and standby instances")
+		collectors = append(collectors, NewDataWatchCollector(*dataWatchPrimary, *dataWatchStandby))
+	}
+	exporter.limits = connectionLimits(dataWatch)
+	if *validateQueries {
+		db, _ := exporter.conn()
+		exporter.invalidQueries = checkQueries(db)
+	}
+	if *reloadInterval > 0 {
+		log.Infoln("Reloading the metrics files when they change, checked every", *reloadInterval, "seconds")
+		reloadSuccessful.Set(1)
+		reloadSuccessTime.SetToCurrentTime()
+		go watchMetricsFiles(time.Duration(*reloadInterval) * time.Second)
+	}
+	if *cardinalityLearn > 0 {
+		learner := newCardinalityLearner(store)
+		exporter.learner = learner
+		remaining := time.Duration(*cardinalityLearn)*time.Second - time.Since(learner.started)
+		if remaining < 0 {
+			remaining = 0
+		}
+		log.Infoln("Learning the series of each metric for", remaining.Round(time.Second))
+		time.AfterFunc(remaining, func() {
+			if err := learner.write(*cardinalityFile); err != nil {
+				log.Errorln("Error while writing the cardinality limits:", err)
+				return
+			}
+			log.Infoln("Suggested cardinality limits written to", *cardinalityFile)
+		})
 	}
-	exporter := NewExporter(dsn)
-	//prometheus.MustRegister(exporter)
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(exporter)
 	//http.Handle(*metricPath,  promhttp.Handler())
 
-	http.Handle(*metricPath,promhttp.HandlerFor(registry,promhttp.HandlerOpts{}))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handlerOpts := promhttp.HandlerOpts{
+		EnableOpenMetrics:  true,
+		DisableCompression: *disableCompression,
+		ErrorHandling:      promhttp.ContinueOnError,
+		Timeout:            time.Duration(*webTimeout) * time.Second,
+	}
+	if *errorHandling == "http-error" {
+		handlerOpts.ErrorHandling = promhttp.HTTPErrorOnError
+	}
+	// The limit of requests in flight is shared by all scrapes, each of them getting its own handler.
+	var inFlight chan struct{}
+	if *maxRequests > 0 {
+		inFlight = make(chan struct{}, *maxRequests)
+	}
+	// Modules served under their own path, e.g. /metrics/tablespace for tablespace.toml
+	modulePrefix := strings.TrimSuffix(*metricPath, "/") + "/"
+	if *modulePaths {
+		modules := make(map[string]bool)
+		for _, metric := range metricsToScrap.Metric {
+			if !modules[metric.module] {
+				modules[metric.module] = true
+				log.Infoln("Serving the metrics of module", metric.module, "on", modulePrefix+metric.module)
+			}
+		}
+	}
+
+	var snapshots *snapshotGatherer
+	if *backgroundInterval > 0 {
+		log.Infoln("Scraping in the background every", *backgroundInterval, "seconds")
+		snapshots = newSnapshotGatherer()
+		go snapshots.run(collectors, time.Duration(*backgroundInterval)*time.Second,
+			time.Duration(*backgroundJitter)*time.Second, handlerOpts.Timeout)
+	}
+	var results *resultCache
+	if *minInterval > 0 {
+		results = &resultCache{interval: time.Duration(*minInterval) * time.Second, collectors: collectors,
+			timeout: handlerOpts.Timeout}
+	}
+
+	// Every scrape gets its own registry so that queries follow the request context.
+	metricsHandler := func(w http.ResponseWriter, r *http.Request) {
+		// Modules and groups are still scraped on request
+		if snapshots != nil && strings.Compare(r.URL.Path, *metricPath) == 0 && len(r.URL.Query()["collect[]"]) == 0 {
+			if !snapshots.hasSnapshot() {
+				http.Error(w, "The first background scrape is not over yet, try again later.", http.StatusServiceUnavailable)
+				return
+			}
+			promhttp.HandlerFor(snapshots, handlerOpts).ServeHTTP(w, r)
+			return
+		}
+		if inFlight != nil {
+			select {
+			case inFlight <- struct{}{}:
+				defer func() { <-inFlight }()
+			default:
+				http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", *maxRequests),
+					http.StatusServiceUnavailable)
+				return
+			}
+		}
+		requestID := r.Header.Get(requestIDHeader)
+		if strings.Compare(requestID, "") == 0 {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		if *webTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, handlerOpts.Timeout)
+			defer cancel()
+		}
+		if results != nil && strings.Compare(r.URL.Path, *metricPath) == 0 && len(r.URL.Query()["collect[]"]) == 0 {
+			promhttp.HandlerFor(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return results.gather(requestID)
+			}), handlerOpts).ServeHTTP(w, r)
+			return
+		}
+		registry := prometheus.NewRegistry()
+		// Only the metrics of the module or of the groups, without the DataWatch pair
+		restricted := false
+		if module := strings.TrimPrefix(r.URL.Path, modulePrefix); strings.Compare(r.URL.Path, *metricPath) != 0 {
+			if !*modulePaths || !hasModule(module) {
+				http.NotFound(w, r)
+				return
+			}
+			ctx = context.WithValue(ctx, moduleKey{}, module)
+			restricted = true
+		}
+		if groups := r.URL.Query()["collect[]"]; len(groups) > 0 {
+			collected := make(map[string]bool)
+			for _, group := range groups {
+				collected[group] = true
+			}
+			ctx = context.WithValue(ctx, collectKey{}, collected)
+			restricted = true
+		}
+		if restricted {
+			registry.MustRegister(requestCollector{ctx: ctx, collector: exporter})
+		} else {
+			for _, collector := range collectors {
+				registry.MustRegister(requestCollector{ctx: ctx, collector: collector})
+			}
+		}
+		promhttp.HandlerFor(registry, handlerOpts).ServeHTTP(w, r)
+	}
+
+	// net/http/pprof registers itself on the default mux, keep it off the telemetry listener.
+	mux := http.NewServeMux()
+	mux.HandleFunc(*metricPath, metricsHandler)
+	if *modulePaths && strings.Compare(modulePrefix, *metricPath) != 0 {
+		mux.HandleFunc(modulePrefix, metricsHandler)
+	}
+	mux.HandleFunc(definitionsPath, definitionsHandler)
+	mux.HandleFunc(statusPath, statusHandler)
+	if *enableDiagnostics {
+		mux.HandleFunc(diagnosticsPath, diagnosticsHandler)
+	}
+	if *enableAdminAPI {
+		mux.HandleFunc(maintenancePath, exporter.maintenance.handler)
+	}
+	if *enableSQLLookup {
+		mux.HandleFunc(sqlPath, sqlHandler)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(landingPage)
 	})
+
+	if *enablePprof {
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			log.Infoln("Serving pprof on", *pprofAddress)
+			log.Fatal(http.ListenAndServe(*pprofAddress, pprofMux))
+		}()
+	}
+
+	listenConfig := net.ListenConfig{}
+	if *webReusePort {
+		listenConfig.Control = reusePort
+	}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", *listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Infoln("Listening on", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+
+	go func() {
+		if *systemdWaitForDB {
+			ping := func() error {
+				db, _ := exporter.conn()
+				return db.Ping()
+			}
+			for err := ping(); err != nil; err = ping() {
+				log.Errorln("Waiting for DM database before notifying systemd:", err)
+				time.Sleep(5 * time.Second)
+			}
+		}
+		if err := sdNotify("READY=1"); err != nil {
+			log.Errorln("Error while notifying systemd:", err)
+		}
+		sdWatchdog(func(timeout time.Duration) error {
+			return exporterAlive(exporter, listener.Addr().String(), timeout)
+		})
+	}()
+
+	// Stop accepting scrapes but let the running ones finish, e.g. while a new exporter takes over
+	server := &http.Server{Handler: mux}
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+		select {
+		case <-stop:
+		case <-stopExporter:
+		}
+		log.Infoln("Stopping, waiting for the running scrapes")
+		if err := sdNotify("STOPPING=1"); err != nil {
+			log.Errorln("Error while notifying systemd:", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorln("Error while stopping:", err)
+		}
+		close(stopped)
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
@@ -0,0 +1,1266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	// 2024-01-01 is a Monday
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(day time.Time, hour, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	friday, saturday := monday.AddDate(0, 0, 4), monday.AddDate(0, 0, 5)
+	tests := []struct {
+		window  string
+		inside  []time.Time
+		outside []time.Time
+	}{
+		{"09:00-18:00", []time.Time{at(monday, 9, 0), at(saturday, 17, 59)}, []time.Time{at(monday, 8, 59), at(monday, 18, 0)}},
+		{"22:00-02:00", []time.Time{at(monday, 23, 0), at(monday, 1, 59)}, []time.Time{at(monday, 2, 0), at(monday, 21, 59)}},
+		{"Mon-Fri 09:00-18:00", []time.Time{at(monday, 12, 0), at(friday, 12, 0)}, []time.Time{at(saturday, 12, 0)}},
+		{"sat,Mon 00:00-01:00", []time.Time{at(saturday, 0, 30), at(monday, 0, 30)}, []time.Time{at(friday, 0, 30)}},
+		// Ranges of weekdays wrap around the week
+		{"Fri-Mon 00:00-01:00", []time.Time{at(friday, 0, 0), at(saturday, 0, 0), at(monday, 0, 0)}, []time.Time{at(monday.AddDate(0, 0, 1), 0, 0)}},
+	}
+	for _, test := range tests {
+		window, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Errorf("parseTimeWindow(%q) failed: %v", test.window, err)
+			continue
+		}
+		for _, inside := range test.inside {
+			if !window.contains(inside) {
+				t.Errorf("parseTimeWindow(%q) does not contain %v", test.window, inside)
+			}
+		}
+		for _, outside := range test.outside {
+			if window.contains(outside) {
+				t.Errorf("parseTimeWindow(%q) contains %v", test.window, outside)
+			}
+		}
+	}
+	for _, window := range []string{"", "Mon Tue 09:00-18:00", "Moon 09:00-18:00", "Mon-Fry 09:00-18:00", "09:00", "09:00-25:00", "9h-18h"} {
+		if _, err := parseTimeWindow(window); err == nil {
+			t.Errorf("parseTimeWindow(%q) succeeded, want an error", window)
+		}
+	}
+}
+
+func TestBooleanValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Y", "1"}, {"yes", "1"}, {"TRUE", "1"}, {"On", "1"},
+		{"N", "0"}, {"no", "0"}, {"false", "0"}, {"OFF", "0"},
+		// Other values are left to the parsing of numbers
+		{"1", "1"}, {"0", "0"}, {"2.5", "2.5"}, {"MAYBE", "MAYBE"}, {"", ""},
+	}
+	for _, test := range tests {
+		if got := booleanValue(test.value); got != test.want {
+			t.Errorf("booleanValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+	}{
+		{"0 00:12:34.567", 754.567},
+		{"1 02:00:00", 93600},
+		{"-1 12:00:00", -129600},
+		{"+0 00:00:01", 1},
+		{"12:34:56", 45296},
+		{"12:34", 45240},
+		{"  00:00:30.  ", 30},
+		{"100:00:00", 360000},
+	}
+	for _, test := range tests {
+		got, err := parseDuration(test.text)
+		if err != nil || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v", test.text, got, err, test.want)
+		}
+	}
+	for _, text := range []string{"", "12", "1 day", "00:00:aa", "1.5 00:00:00", "P1D"} {
+		if _, err := parseDuration(text); err == nil {
+			t.Errorf("parseDuration(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestParseTimeIn(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	tests := []struct {
+		value    string
+		layouts  []string
+		location *time.Location
+		want     time.Time
+	}{
+		// Epoch seconds, whatever the layouts
+		{"1700000000", timeLayouts, shanghai, time.Unix(1700000000, 0)},
+		{"1700000000.5", nil, time.UTC, time.Unix(1700000000, 500000000)},
+		// Times without zone are in the given location
+		{"2024-01-02 03:04:05", timeLayouts, shanghai, time.Date(2024, 1, 2, 3, 4, 5, 0, shanghai)},
+		{"2024-01-02 03:04:05.123456", timeLayouts, time.UTC, time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)},
+		{"2024-01-02", timeLayouts, time.UTC, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{" 2024-01-02 03:04:05 ", timeLayouts, time.UTC, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		// Times with a zone keep it
+		{"2024-01-02T03:04:05+02:00", timeLayouts, shanghai, time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC)},
+		// timelayout
+		{"02/01/2024 03:04", []string{"02/01/2006 15:04"}, time.UTC, time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseTimeIn(test.value, test.layouts, test.location)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseTimeIn(%q) = %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"", "yesterday", "2024-13-02", "2024-01-02 03:04"} {
+		if _, err := parseTimeIn(value, timeLayouts, time.UTC); err == nil {
+			t.Errorf("parseTimeIn(%q) succeeded, want an error", value)
+		}
+	}
+	if _, err := parseTimeIn("2024-01-02", []string{"02/01/2006"}, time.UTC); err == nil {
+		t.Errorf("parseTimeIn() succeeded with a value not matching timelayout")
+	}
+}
+
+func TestFormattedNumber(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		// Grouped
+		{"1,234,567.89", "1234567.89"},
+		{"1 234 567", "1234567"},
+		{"1_234", "1234"},
+		{"-12,345", "-12345"},
+		// Percentages
+		{"45.2 %", "45.2"},
+		{"45.2%", "45.2"},
+		{" 1,234.5 % ", "1234.5"},
+		// Scientific
+		{"1.5e+10", "1.5e+10"},
+		{"1,234.5E-3", "1234.5E-3"},
+		// Left as is, not being grouped by thousands
+		{"12,34", "12,34"},
+		{"1,2345", "1,2345"},
+		{"1234", "1234"},
+		{"abc", "abc"},
+	}
+	for _, test := range tests {
+		if got := formattedNumber(test.text); got != test.want {
+			t.Errorf("formattedNumber(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+	// With strictvalues the formatted numbers are not cleaned, and fail to parse
+	for _, text := range []string{"1,234", "45 %", "1 234"} {
+		if _, err := parseValue("", text, "", time.UTC); err == nil {
+			t.Errorf("parseValue(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestSQLFingerprint(t *testing.T) {
+	same := [][]string{
+		{"SELECT * FROM V$SESSIONS WHERE STATE = 'ACTIVE'", "select *  from v$sessions\nwhere state = 'IDLE'"},
+		{"SELECT COUNT(*) FROM T WHERE ID = 1", "SELECT COUNT(*) FROM T WHERE ID = 2.5"},
+		{"SELECT 1 /* tag */ FROM DUAL", "-- scrape\nSELECT 1 FROM DUAL"},
+		{"SELECT 'it''s' FROM DUAL", "SELECT 'other' FROM DUAL"},
+	}
+	for _, statements := range same {
+		if a, b := sqlFingerprint(statements[0]), sqlFingerprint(statements[1]); a != b {
+			t.Errorf("sqlFingerprint(%q) = %s and sqlFingerprint(%q) = %s, want the same", statements[0], a, statements[1], b)
+		}
+	}
+	different := [][]string{
+		{"SELECT * FROM V$SESSIONS", "SELECT * FROM V$SESSION"},
+		{"SELECT A FROM T", "SELECT B FROM T"},
+		{"SELECT COL1 FROM T", "SELECT COL2 FROM T"},
+	}
+	for _, statements := range different {
+		if a, b := sqlFingerprint(statements[0]), sqlFingerprint(statements[1]); a == b {
+			t.Errorf("sqlFingerprint(%q) and sqlFingerprint(%q) = %s, want different fingerprints", statements[0], statements[1], a)
+		}
+	}
+	if fingerprint := sqlFingerprint("SELECT 1 FROM DUAL"); len(fingerprint) != 16 {
+		t.Errorf("sqlFingerprint() = %q, want 16 hexadecimal digits", fingerprint)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"8", "8", 0},
+		{"8", "8.0", 0},
+		{"7.6", "8", -1},
+		{"8.1.2.84", "8.1.2.128", -1},
+		{"8.1", "8.1.0.1", -1},
+		{"10", "9", 1},
+		{"8.4", "8.10", -1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestInVersions(t *testing.T) {
+	tests := []struct {
+		minVersion, maxVersion string
+		version                string
+		want                   bool
+	}{
+		{"", "", "7.6", true},
+		{"8", "", "8.1.2.84", true},
+		{"8", "", "7.6.1", false},
+		{"", "7", "7.6", true},
+		{"", "7", "7", true},
+		// A maximum covers its minor versions
+		{"", "7.6", "7.6.0.1", true},
+		{"", "7.6", "7.7", false},
+		{"", "7", "8", false},
+		{"7.6", "8.1", "8.1", true},
+		{"7.6", "8.1", "8.2", false},
+	}
+	for _, test := range tests {
+		metric := Metric{MinVersion: test.minVersion, MaxVersion: test.maxVersion}
+		if got := metric.inVersions(test.version); got != test.want {
+			t.Errorf("inVersions(%q) with minversion %q and maxversion %q = %v, want %v",
+				test.version, test.minVersion, test.maxVersion, got, test.want)
+		}
+	}
+}
+
+func TestColumnList(t *testing.T) {
+	type definition struct {
+		FieldToAppend columnList `toml:"fieldtoappend" yaml:"fieldtoappend" json:"fieldtoappend"`
+	}
+	tests := []struct {
+		format string
+		text   string
+		want   columnList
+	}{
+		{"toml", `fieldtoappend = "name"`, columnList{"name"}},
+		{"toml", `fieldtoappend = [ "class", "name" ]`, columnList{"class", "name"}},
+		{"yaml", `fieldtoappend: name`, columnList{"name"}},
+		{"yaml", `fieldtoappend: [ class, name ]`, columnList{"class", "name"}},
+		{"json", `{"fieldtoappend": "name"}`, columnList{"name"}},
+		{"json", `{"fieldtoappend": ["class", "name"]}`, columnList{"class", "name"}},
+	}
+	decode := func(format, text string, v interface{}) error {
+		switch format {
+		case "toml":
+			_, err := toml.Decode(text, v)
+			return err
+		case "yaml":
+			return yaml.Unmarshal([]byte(text), v)
+		}
+		return json.Unmarshal([]byte(text), v)
+	}
+	for _, test := range tests {
+		var decoded definition
+		if err := decode(test.format, test.text, &decoded); err != nil || !reflect.DeepEqual(decoded.FieldToAppend, test.want) {
+			t.Errorf("decoding %s %q = %q, %v, want %q", test.format, test.text, decoded.FieldToAppend, err, test.want)
+		}
+	}
+	for _, text := range []string{`fieldtoappend = 1`, `fieldtoappend = [ "name", 1 ]`} {
+		var decoded definition
+		if err := decode("toml", text, &decoded); err == nil {
+			t.Errorf("decoding toml %q succeeded, want an error", text)
+		}
+	}
+	// A single column is written back as a string
+	for _, list := range []columnList{{"name"}, {"class", "name"}} {
+		encoded, err := json.Marshal(list)
+		var decoded columnList
+		if err == nil {
+			err = json.Unmarshal(encoded, &decoded)
+		}
+		if err != nil || !reflect.DeepEqual(decoded, list) {
+			t.Errorf("json round trip of %q = %q, %v", list, decoded, err)
+		}
+	}
+}
+
+func TestMaskDSN(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"dm://SYSDBA:SYSDBA@localhost:5236?autoCommit=true", "dm://SYSDBA@localhost:5236?autoCommit=true"},
+		{"dm://SYSDBA@localhost:5236", "dm://SYSDBA@localhost:5236"},
+		{"dm://localhost:5236", "dm://localhost:5236"},
+		// Passwords that can not be parsed as a URL
+		{"dm://SYSDBA:pa#ss@localhost:5236", "dm://SYSDBA@localhost:5236"},
+		{"dm://SYSDBA:pa/ss@localhost:5236", "dm://SYSDBA@localhost:5236"},
+		{"dm://SYSDBA:pa%zzss@localhost:5236", "dm://SYSDBA@localhost:5236"},
+		{"dm://SYSDBA:p@ss:w?rd@localhost:5236?autoCommit=true", "dm://SYSDBA@localhost:5236?autoCommit=true"},
+		// DSNs that are not URLs
+		{"SYSDBA/secret@localhost:5236", "SYSDBA@localhost:5236"},
+		{"SYSDBA:secret@localhost:5236", "SYSDBA@localhost:5236"},
+		{"localhost:5236", "localhost:5236"},
+	}
+	for _, test := range tests {
+		if got := maskDSN(test.dsn); got != test.want {
+			t.Errorf("maskDSN(%q) = %q, want %q", test.dsn, got, test.want)
+		}
+	}
+}
+
+// dependsOn is a metric of a context, depending on another context unless it is empty.
+func dependsOn(context, dependency string) Metric {
+	metric := Metric{Context: context}
+	if dependency != "" {
+		metric.DependsOn = &Dependency{Context: dependency}
+	}
+	return metric
+}
+
+func TestDependencyOrder(t *testing.T) {
+	critical := dependsOn("critical", "")
+	critical.Tier = tierCritical
+	tests := []struct {
+		name    string
+		metrics []Metric
+		want    string
+	}{
+		{"no dependency", []Metric{dependsOn("a", ""), dependsOn("b", "")}, "a b"},
+		{"dependency after", []Metric{dependsOn("a", "b"), dependsOn("b", "")}, "b a"},
+		{"chain", []Metric{dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c", "")}, "c b a"},
+		{"deepest dependency", []Metric{dependsOn("a", "c"), dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c", "")}, "c b a a"},
+		{"critical first", []Metric{dependsOn("a", ""), critical, dependsOn("b", "")}, "critical a b"},
+		{"dependency before critical", []Metric{critical, dependsOn("a", "b"), dependsOn("b", "")}, "critical b a"},
+	}
+	for _, test := range tests {
+		contexts := []string{}
+		for _, metric := range dependencyOrder(test.metrics) {
+			contexts = append(contexts, metric.Context)
+		}
+		if got := strings.Join(contexts, " "); got != test.want {
+			t.Errorf("%s: dependencyOrder() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []Metric
+		want    string
+	}{
+		{"no dependency", []Metric{dependsOn("a", ""), dependsOn("b", "")}, ""},
+		{"known context", []Metric{dependsOn("a", "b"), dependsOn("b", "")}, ""},
+		{"shared dependency", []Metric{dependsOn("a", "c"), dependsOn("b", "c"), dependsOn("c", "")}, ""},
+		{"unknown context", []Metric{dependsOn("a", "b")}, "Metric a depends on unknown context b"},
+		{"self", []Metric{dependsOn("a", "a")}, "Dependency cycle detected on context a"},
+		{"cycle", []Metric{dependsOn("a", "b"), dependsOn("b", "c"), dependsOn("c", "a")}, "Dependency cycle detected"},
+	}
+	for _, test := range tests {
+		err := checkDependencies(test.metrics)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: checkDependencies() = %v, want no error", test.name, err)
+		case test.want != "" && (err == nil || !strings.HasPrefix(err.Error(), test.want)):
+			t.Errorf("%s: checkDependencies() = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+// timeoutError is a network error, as returned by a dial.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+		kind string
+	}{
+		{errors.New("Error 6001: network error"), "6001", errorConnection},
+		{fmt.Errorf("query failed: %w", errors.New("Error 3001: connection lost")), "3001", errorConnection},
+		{errors.New("Error -2501: invalid user name or password"), "-2501", errorAuth},
+		{errors.New("Error 5001: login failed"), "5001", errorAuth},
+		{errors.New("Error -2207: syntax error"), "-2207", errorSQL},
+		{errors.New("Error 70: unknown"), "70", errorOther},
+		{context.DeadlineExceeded, "none", errorTimeout},
+		{errQueryTimeout, "none", errorTimeout},
+		{fmt.Errorf("scrape: %w", context.DeadlineExceeded), "none", errorTimeout},
+		{driver.ErrBadConn, "none", errorConnection},
+		{errors.New("sql: database is closed"), "none", errorConnection},
+		{timeoutError{}, "none", errorConnection},
+		{errors.New("converting NULL to float64"), "none", errorOther},
+	}
+	for _, test := range tests {
+		got := classifyError(test.err)
+		if len(got) != 2 || got[0] != test.code || got[1] != test.kind {
+			t.Errorf("classifyError(%q) = %q, want [%q %q]", test.err, got, test.code, test.kind)
+		}
+	}
+}
+
+func TestUniqueSeries(t *testing.T) {
+	desc := prometheus.NewDesc("dmdb_test_value", "Test.", []string{"name"}, nil)
+	other := prometheus.NewDesc("dmdb_test_other", "Test.", []string{"name"}, nil)
+	invalid := prometheus.NewInvalidMetric(desc, errors.New("invalid"))
+	tests := []struct {
+		name    string
+		metrics []prometheus.Metric
+		want    int
+	}{
+		{"distinct labels", []prometheus.Metric{
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "a"),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "b"),
+		}, 2},
+		{"same labels", []prometheus.Metric{
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "a"),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "a"),
+		}, 1},
+		{"same labels of other metrics", []prometheus.Metric{
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "a"),
+			prometheus.MustNewConstMetric(other, prometheus.GaugeValue, 2, "a"),
+		}, 2},
+		{"invalid metrics", []prometheus.Metric{invalid, invalid}, 2},
+	}
+	for _, test := range tests {
+		ch := make(chan prometheus.Metric, len(test.metrics))
+		unique, flush := uniqueSeries(ch, log.Base())
+		for _, metric := range test.metrics {
+			unique <- metric
+		}
+		flush()
+		if got := len(ch); got != test.want {
+			t.Errorf("%s: uniqueSeries() sent %d metrics, want %d", test.name, got, test.want)
+		}
+		// The first series is kept
+		if test.name == "same labels" {
+			var series dto.Metric
+			if err := (<-ch).Write(&series); err != nil || series.GetGauge().GetValue() != 1 {
+				t.Errorf("%s: uniqueSeries() kept %v, want the first series", test.name, series.GetGauge())
+			}
+		}
+	}
+}
+
+func TestScrapeQueue(t *testing.T) {
+	q := newScrapeQueue()
+	if !q.tryAcquire() {
+		t.Fatal("tryAcquire() = false on a free queue")
+	}
+	if q.tryAcquire() {
+		t.Fatal("tryAcquire() = true on a busy queue")
+	}
+	// Queued in this order while the target is busy
+	queued := []string{"big", "big", "big", "", "small"}
+	order := make(chan string, len(queued))
+	for i, module := range queued {
+		module := module
+		go func() {
+			if err := q.acquire(context.Background(), module); err != nil {
+				t.Error("acquire() failed:", err)
+			}
+			order <- module
+		}()
+		for waiting := 0; waiting <= i; {
+			time.Sleep(time.Millisecond)
+			q.mu.Lock()
+			waiting = 0
+			for _, turns := range q.waiting {
+				waiting += len(turns)
+			}
+			q.mu.Unlock()
+		}
+	}
+	// The modules take turns, whatever the number of scrapes they queued
+	want := []string{"big", "", "small", "big", "big"}
+	for _, module := range want {
+		q.release()
+		if got := <-order; got != module {
+			t.Fatalf("scrape of module %q got the target, want %q", got, module)
+		}
+	}
+	q.release()
+	if !q.tryAcquire() {
+		t.Error("tryAcquire() = false once every scrape released the target")
+	}
+	// A scrape giving up leaves the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.acquire(ctx, "big"); err == nil {
+		t.Error("acquire() succeeded on a busy queue")
+	}
+	if len(q.turns) != 0 || len(q.waiting) != 0 {
+		t.Errorf("acquire() left %v waiting after giving up", q.turns)
+	}
+	q.release()
+	if !q.tryAcquire() {
+		t.Error("tryAcquire() = false after the last scrape gave up")
+	}
+}
+
+func TestScrapeGenericValues(t *testing.T) {
+	rows := []map[string]string{
+		{"name": "Logical Reads", "state": "ACTIVE", "value": "1,234", "enabled": "Y"},
+		{"name": "Physical Reads", "state": "IDLE", "value": "56", "enabled": "N"},
+	}
+	tests := []struct {
+		name       string
+		definition Metric
+		want       []string
+	}{
+		{"labels", Metric{
+			Context:     "sessions",
+			Labels:      []string{"state"},
+			MetricsDesc: map[string]string{"value": "Value."},
+		}, []string{"dmdb_sessions_value{state=ACTIVE} 1234", "dmdb_sessions_value{state=IDLE} 56"}},
+		{"fieldtoappend", Metric{
+			Context:       "sysstat",
+			FieldToAppend: columnList{"name"},
+			MetricsDesc:   map[string]string{"value": "Value."},
+		}, []string{"dmdb_sysstat_logical_reads 1234", "dmdb_sysstat_physical_reads 56"}},
+		{"booleans and constant labels", Metric{
+			Context:       "stat",
+			Labels:        []string{"name"},
+			ConstLabels:   map[string]string{"role": "standby"},
+			MetricsDesc:   map[string]string{"enabled": "Enabled."},
+			BooleanValues: true,
+		}, []string{"dmdb_stat_enabled{name=Logical Reads,role=standby} 1", "dmdb_stat_enabled{name=Physical Reads,role=standby} 0"}},
+	}
+	for _, test := range tests {
+		ch := make(chan prometheus.Metric, 10)
+		totals := make(map[string]float64)
+		if err := ScrapeGenericValues(context.Background(), nil, ch, test.definition, nil, rows, totals, nil); err != nil {
+			t.Errorf("%s: ScrapeGenericValues() failed: %v", test.name, err)
+			continue
+		}
+		close(ch)
+		got := []string{}
+		for metric := range ch {
+			var series dto.Metric
+			if err := metric.Write(&series); err != nil {
+				t.Fatal(err)
+			}
+			labels := []string{}
+			for _, label := range series.Label {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			name := descName.FindStringSubmatch(metric.Desc().String())[1]
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			value := series.GetGauge().GetValue()
+			got = append(got, name+" "+strconv.FormatFloat(value, 'f', -1, 64))
+		}
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: ScrapeGenericValues() exported\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestMaskFlag(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"datawatch.primary-dsn", "dm://SYSDBA:secret@primary:5236", "dm://SYSDBA@primary:5236"},
+		{"query.vars", "schema=APP,password=secret", "schema=<masked>,password=<masked>"},
+		{"query.vars", "", ""},
+		{"web.tls-key-file", "/etc/exporter/key.pem", "<masked>"},
+		{"web.api-token", "", ""},
+		{"web.listen-address", ":9161", ":9161"},
+	}
+	for _, test := range tests {
+		if got := maskFlag(test.name, test.value); got != test.want {
+			t.Errorf("maskFlag(%q, %q) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestRestrictsRole(t *testing.T) {
+	tests := []struct {
+		roles []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"", "any", "ANY"}, false},
+		{[]string{"", "primary"}, true},
+		{[]string{"Standby"}, true},
+	}
+	for _, test := range tests {
+		metrics := []Metric{}
+		for _, role := range test.roles {
+			metrics = append(metrics, Metric{Role: role})
+		}
+		if got := restrictsRole(metrics); got != test.want {
+			t.Errorf("restrictsRole(%q) = %v, want %v", test.roles, got, test.want)
+		}
+	}
+}
+
+func TestQueryCacheRetries(t *testing.T) {
+	db, err := sql.Open("dm", "dm://SYSDBA:SYSDBA@localhost:5236")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	timeout := *queryTimeout
+	*queryTimeout = "5"
+	defer func() { *queryTimeout = timeout }()
+	// Canceled, so that the query fails without connecting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache := newQueryCache(ctx, db, []Query{{Name: "sessions", Request: "SELECT 1 FROM DUAL"}})
+	result := cache.results["sessions"]
+	if _, err := cache.get("unknown"); err == nil {
+		t.Errorf("get(%q) succeeded, want an error", "unknown")
+	}
+	// The failures are not kept
+	for i := 0; i < 2; i++ {
+		if _, err := cache.get("sessions"); err == nil {
+			t.Fatalf("get(%q) succeeded on a canceled context", "sessions")
+		}
+		if result.done {
+			t.Fatalf("get(%q) kept a failed result", "sessions")
+		}
+	}
+	result.rows, result.done = []map[string]string{{"state": "ACTIVE"}}, true
+	rows, err := cache.get("sessions")
+	if err != nil || len(rows) != 1 {
+		t.Errorf("get(%q) = %v, %v, want the kept rows", "sessions", rows, err)
+	}
+}
+
+func TestLoadMetricsFileProblems(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "custom.toml")
+	content := `
+[[metric]]
+context = "sessions"
+request = "SELECT COUNT(*) AS count FROM V$SESSIONS"
+
+[[metric]]
+context = "events"
+labels = [ "event" ]
+request = "SELECT EVENT, TOTAL_WAITS FROM V$SYSTEM_EVENT"
+metricsdesc = { total_waits = "Number of waits." }
+sanitize = { labels = [ "wait_class" ] }
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems := []string{}
+	collectProblems(&problems, func() {
+		loadMetricsFile(file, make(map[string]string), make(map[string][]contextUse))
+	})
+	want := []string{
+		"Sanitized column wait_class of metric events is not one of its labels",
+		`metric[0] (context "sessions"): missing metricsdesc`,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("loadMetricsFile found %d problems, want %d: %q", len(problems), len(want), problems)
+	}
+	for i, problem := range problems {
+		if !strings.Contains(problem, want[i]) {
+			t.Errorf("problem %d = %q, want %q", i, problem, want[i])
+		}
+	}
+}
+
+func TestParseHistogram(t *testing.T) {
+	tests := []struct {
+		row     map[string]string
+		buckets map[string]string
+		count   uint64
+		sum     float64
+		want    map[float64]uint64
+		err     string
+	}{
+		// le_* columns, whatever their order in the row
+		{map[string]string{"le_1": "8", "count": "10", "le_0_01": "2", "sum": "3.5", "le_0_1": "5"}, nil,
+			10, 3.5, map[float64]uint64{0.01: 2, 0.1: 5, 1: 8}, ""},
+		// The +Inf bucket is the count
+		{map[string]string{"count": "10", "sum": "3.5", "le_0_1": "5", "fast": "5", "all": "10"},
+			map[string]string{"fast": "0.1", "all": "+Inf"}, 10, 3.5, map[float64]uint64{0.1: 5}, ""},
+		{map[string]string{"count": "10", "sum": "3.5"}, nil, 10, 3.5, map[float64]uint64{}, ""},
+		// Observations of each range only
+		{map[string]string{"count": "10", "sum": "3.5", "le_0_01": "2", "le_0_1": "5", "le_1": "1"}, nil,
+			0, 0, nil, "bucket 1 <1> is below the previous one"},
+		{map[string]string{"count": "4", "sum": "3.5", "le_0_1": "5"}, nil,
+			0, 0, nil, "bucket +Inf <4> is below the previous one"},
+		{map[string]string{"count": "", "sum": "3.5"}, nil, 0, 0, nil, "invalid count"},
+		{map[string]string{"count": "10", "sum": "3.5", "le_0_1": "n/a"}, nil, 0, 0, nil, "invalid bucket le_0_1"},
+		{map[string]string{"count": "10", "sum": "3.5", "fast": "5"}, map[string]string{"fast": "low"},
+			0, 0, nil, "invalid upper bound low"},
+	}
+	for _, test := range tests {
+		count, sum, buckets, err := parseHistogram(test.row, test.buckets)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseHistogram(%v) error = %v, want %q", test.row, err, test.err)
+			}
+			continue
+		}
+		if err != nil || count != test.count || sum != test.sum || !reflect.DeepEqual(buckets, test.want) {
+			t.Errorf("parseHistogram(%v) = %d, %v, %v, %v, want %d, %v, %v", test.row, count, sum, buckets, err,
+				test.count, test.sum, test.want)
+		}
+	}
+}
+
+func TestParseSummary(t *testing.T) {
+	tests := []struct {
+		row   map[string]string
+		count uint64
+		sum   float64
+		want  map[float64]float64
+		err   string
+	}{
+		{map[string]string{"count": "1000", "sum": "31.2", "q5": "0.004", "q99": "0.83", "q999": "1.2"},
+			1000, 31.2, map[float64]float64{0.5: 0.004, 0.99: 0.83, 0.999: 1.2}, ""},
+		// Columns that are not quantiles are ignored
+		{map[string]string{"count": "3", "sum": "1", "q50": "0.2", "quantile": "x", "q": "y"},
+			3, 1, map[float64]float64{0.5: 0.2}, ""},
+		{map[string]string{"count": "3", "sum": ""}, 0, 0, nil, "invalid sum"},
+		{map[string]string{"count": "3", "sum": "1", "q50": "fast"}, 0, 0, nil, "invalid quantile q50"},
+	}
+	for _, test := range tests {
+		count, sum, quantiles, err := parseSummary(test.row)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseSummary(%v) error = %v, want %q", test.row, err, test.err)
+			}
+			continue
+		}
+		if err != nil || count != test.count || sum != test.sum || !reflect.DeepEqual(quantiles, test.want) {
+			t.Errorf("parseSummary(%v) = %d, %v, %v, %v, want %d, %v, %v", test.row, count, sum, quantiles, err,
+				test.count, test.sum, test.want)
+		}
+	}
+}
+
+func TestCompositeColumns(t *testing.T) {
+	row := map[string]string{
+		"reads":               "12",
+		"read_seconds_count":  "10",
+		"read_seconds_sum":    "3.5",
+		"read_seconds_le_0_1": "4",
+		"write_seconds_count": "6",
+		"write_seconds_sum":   "1.5",
+	}
+	tests := []struct {
+		metric string
+		want   map[string]string
+	}{
+		{"read_seconds", map[string]string{"count": "10", "sum": "3.5", "le_0_1": "4"}},
+		{"WRITE_SECONDS", map[string]string{"count": "6", "sum": "1.5"}},
+		// Without a <metric>_count column, the whole row
+		{"latency", row},
+	}
+	for _, test := range tests {
+		if got := compositeColumns(row, test.metric); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("compositeColumns(%q) = %v, want %v", test.metric, got, test.want)
+		}
+	}
+}
+
+func TestDecodeMetricsFileUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		// Keys decoded by UnmarshalTOML are known
+		{"known.toml", `
+[[metric]]
+context = "sessions"
+request = "SELECT COUNT(*) AS count FROM V$SESSIONS"
+metricsdesc = { count = "Number of sessions." }
+fieldtoappend = "state"
+dependson = { context = "instance", metric = "up", above = 0 }
+`, nil},
+		{"typo.toml", `
+[[metric]]
+context = "sessions"
+requets = "SELECT COUNT(*) AS count FROM V$SESSIONS"
+metricsdesc = { count = "Number of sessions." }
+dependson = { context = "instance", abve = 0 }
+`, []string{
+			"typo.toml:4: unknown key metric.requets, did you mean request?",
+			"typo.toml:6: unknown key metric.dependson.abve, did you mean above?",
+		}},
+		{"table.toml", `
+[[metrics]]
+context = "sessions"
+`, []string{"table.toml:2: unknown key metrics, did you mean metric?"}},
+		{"known.yaml", `
+metric:
+  - context: sessions
+    request: SELECT COUNT(*) AS count FROM V$SESSIONS
+    metricsdesc: { count: Number of sessions. }
+    fieldtoappend: state
+    dependson: { context: instance, above: 0 }
+`, nil},
+		{"typo.yaml", `
+metric:
+  - context: sessions
+    metricsdescs: { count: Number of sessions. }
+    dependson: { context: instance, abov: 0 }
+`, []string{
+			"typo.yaml:4: unknown key metricsdescs, did you mean metricsdesc?",
+			"typo.yaml:5: unknown key abov, did you mean above?",
+		}},
+		// Too far from any key to suggest one
+		{"far.yaml", `
+metric:
+  - context: sessions
+    frequency: 10
+`, []string{"far.yaml:4: unknown key frequency"}},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := decodeMetricsFile(path, &Metrics{})
+		if test.want == nil {
+			if err != nil {
+				t.Errorf("decodeMetricsFile(%s) = %v, want no error", test.name, err)
+			}
+			continue
+		}
+		want := dir + string(filepath.Separator) + strings.Join(test.want, "\n"+dir+string(filepath.Separator))
+		if err == nil || err.Error() != want {
+			t.Errorf("decodeMetricsFile(%s) = %v, want %s", test.name, err, want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"request", "request", 0},
+		{"", "above", 5},
+		{"requets", "request", 2},
+		{"metricsdescs", "metricsdesc", 1},
+		{"abve", "above", 1},
+		{"labels", "lables", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := editDistance(test.b, test.a); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	store, err := openStateStore(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state learnedCardinality
+	if store.load("cardinality", &state) {
+		t.Fatal("load found a state before any was saved")
+	}
+	saved := learnedCardinality{Scrapes: 3, Max: map[string]int64{"sessions": 12}}
+	if err := store.save("cardinality", saved); err != nil {
+		t.Fatal(err)
+	}
+	if !store.load("cardinality", &state) || !reflect.DeepEqual(state, saved) {
+		t.Errorf("load = %+v, want %+v", state, saved)
+	}
+	content, err := ioutil.ReadFile(store.path("cardinality"))
+	if err != nil || !strings.Contains(string(content), `"version": 1`) {
+		t.Errorf("saved state %s (%v) has no version", content, err)
+	}
+	// No temporary file is left behind
+	files, _ := filepath.Glob(filepath.Join(store.dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("store holds %v, want only the state", files)
+	}
+
+	// A state written by a newer exporter is ignored and kept as is
+	newer := []byte(`{"version": 2, "data": {"scrapes": 5}}`)
+	if err := ioutil.WriteFile(store.path("cardinality"), newer, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if store.load("cardinality", &learnedCardinality{}) {
+		t.Error("load read a state of a newer version")
+	}
+	if content, _ := ioutil.ReadFile(store.path("cardinality")); string(content) != string(newer) {
+		t.Errorf("state of a newer version was changed to %s", content)
+	}
+
+	if err := store.remove("cardinality"); err != nil {
+		t.Error(err)
+	}
+	if err := store.remove("cardinality"); err != nil {
+		t.Errorf("remove of a missing state = %v", err)
+	}
+	var none *stateStore
+	if none.load("cardinality", &state) || none.save("cardinality", saved) != nil || none.remove("cardinality") != nil {
+		t.Error("a nil store keeps a state")
+	}
+}
+
+func TestStateStoreCorrupt(t *testing.T) {
+	tests := []string{
+		`{"version": 1, "data": `,
+		`{"version": 1, "data": {"scrapes": "three"}}`,
+	}
+	for _, content := range tests {
+		store, err := openStateStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(store.path("cardinality"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if store.load("cardinality", &learnedCardinality{}) {
+			t.Errorf("load read the corrupt state %s", content)
+		}
+		if _, err := os.Stat(store.path("cardinality")); !os.IsNotExist(err) {
+			t.Errorf("corrupt state %s was not moved aside", content)
+		}
+		corrupt, _ := filepath.Glob(store.path("cardinality") + ".corrupt-*")
+		if len(corrupt) != 1 {
+			t.Fatalf("corrupt state %s moved to %v, want one .corrupt file", content, corrupt)
+		}
+		if moved, _ := ioutil.ReadFile(corrupt[0]); string(moved) != content {
+			t.Errorf("corrupt state moved as %s, want %s", moved, content)
+		}
+		// The exporter starts afresh
+		if err := store.save("cardinality", learnedCardinality{Scrapes: 1}); err != nil {
+			t.Fatal(err)
+		}
+		var state learnedCardinality
+		if !store.load("cardinality", &state) || state.Scrapes != 1 {
+			t.Errorf("load after recovery = %+v", state)
+		}
+	}
+}
+
+func TestSanitizeApply(t *testing.T) {
+	keepCase := false
+	tests := []struct {
+		sanitize *Sanitize
+		value    string
+		want     string
+	}{
+		// Without pipeline, cleanName
+		{nil, "Buffer Hits (Total)", "buffer_hits_total"},
+		{&Sanitize{}, "Buffer Hits", "buffer hits"},
+		{&Sanitize{Lowercase: &keepCase}, "Buffer Hits", "Buffer Hits"},
+		// Replacements apply in order, referencing their groups
+		{&Sanitize{Replace: []Replacement{
+			{Pattern: `[^A-Za-z0-9_]+`, Replacement: "_"},
+			{Pattern: `^_+|_+$`, Replacement: ""},
+		}}, " Buffer Hits (Total) ", "buffer_hits_total"},
+		{&Sanitize{Replace: []Replacement{{Pattern: `(\w+)@(\w+)`, Replacement: "${2}_$1"}}}, "READ@NODE1", "node1_read"},
+		// Cut to maxlength characters, not bytes
+		{&Sanitize{MaxLength: 4}, "Buffer", "buff"},
+		{&Sanitize{MaxLength: 3, Lowercase: &keepCase}, "缓冲区命中", "缓冲区"},
+		{&Sanitize{MaxLength: 10}, "short", "short"},
+	}
+	for _, test := range tests {
+		if test.sanitize != nil {
+			for i := range test.sanitize.Replace {
+				test.sanitize.Replace[i].regexp = regexp.MustCompile(test.sanitize.Replace[i].Pattern)
+			}
+		}
+		if got := test.sanitize.apply(test.value); got != test.want {
+			t.Errorf("apply(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestLoadMetricsFileSanitizeLabels(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{`
+[sanitize]
+labels = [ "event" ]
+
+[[metric]]
+context = "events"
+labels = [ "event" ]
+request = "SELECT EVENT AS event, TOTAL_WAITS AS waits FROM V$SYSTEM_EVENT"
+metricsdesc = { waits = "Total waits of the event." }
+`, ""},
+		// Only a label of a metric with its own sanitize
+		{`
+[sanitize]
+labels = [ "event" ]
+
+[[metric]]
+context = "events"
+labels = [ "event" ]
+request = "SELECT EVENT AS event, TOTAL_WAITS AS waits FROM V$SYSTEM_EVENT"
+metricsdesc = { waits = "Total waits of the event." }
+sanitize = { lowercase = false }
+`, "Sanitized column event of "},
+		{`
+[sanitize]
+labels = [ "evnt" ]
+
+[[metric]]
+context = "events"
+labels = [ "event" ]
+request = "SELECT EVENT AS event, TOTAL_WAITS AS waits FROM V$SYSTEM_EVENT"
+metricsdesc = { waits = "Total waits of the event." }
+`, "Sanitized column evnt of "},
+	}
+	for _, test := range tests {
+		file := filepath.Join(t.TempDir(), "custom.toml")
+		if err := ioutil.WriteFile(file, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		problems := []string{}
+		collectProblems(&problems, func() {
+			defer func() { metricsToScrap, metricsFiles = Metrics{}, nil }()
+			loadMetricsFile(file, make(map[string]string), make(map[string][]contextUse))
+		})
+		if test.want == "" && len(problems) > 0 || test.want != "" && (len(problems) != 1 || !strings.Contains(problems[0], test.want)) {
+			t.Errorf("loadMetricsFile(%s) found %q, want %q", test.content, problems, test.want)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("DMDB_TEST_SCHEMA", "APP")
+	t.Setenv("DMDB_TEST_EMPTY", "")
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"SELECT * FROM ${DMDB_TEST_SCHEMA}.QUEUE", "SELECT * FROM APP.QUEUE", ""},
+		{"${DMDB_TEST_SCHEMA}${DMDB_TEST_EMPTY}_${DMDB_TEST_SCHEMA}", "APP_APP", ""},
+		// Only the ${VAR} form, $ being part of the names of DM views
+		{"SELECT * FROM V$SESSIONS WHERE $DMDB_TEST_SCHEMA", "SELECT * FROM V$SESSIONS WHERE $DMDB_TEST_SCHEMA", ""},
+		{"${1SCHEMA} ${}", "${1SCHEMA} ${}", ""},
+		{"SELECT * FROM ${DMDB_TEST_UNSET}", "", "Environment variable DMDB_TEST_UNSET used in custom.toml is not set"},
+	}
+	for _, test := range tests {
+		problems := []string{}
+		var got string
+		collectProblems(&problems, func() { got = expandEnv(test.value, "custom.toml") })
+		if test.err != "" {
+			if len(problems) != 1 || problems[0] != test.err {
+				t.Errorf("expandEnv(%q) failed with %q, want %q", test.value, problems, test.err)
+			}
+			continue
+		}
+		if len(problems) > 0 || got != test.want {
+			t.Errorf("expandEnv(%q) = %q, %q, want %q", test.value, got, problems, test.want)
+		}
+	}
+}
+
+func TestRenderRequest(t *testing.T) {
+	vars := map[string]string{"Schema": "APP", "TopN": "10"}
+	tests := []struct {
+		request string
+		want    string
+		err     string
+	}{
+		{"SELECT 1 FROM DUAL", "SELECT 1 FROM DUAL", ""},
+		{"SELECT * FROM {{.Schema}}.T LIMIT {{.TopN}}", "SELECT * FROM APP.T LIMIT 10", ""},
+		{"SELECT * FROM {{.Owner}}.T", "", "Error while rendering a request of custom.toml"},
+		{"SELECT * FROM {{.Schema}.T", "", "Invalid request template in custom.toml"},
+	}
+	for _, test := range tests {
+		problems := []string{}
+		var got string
+		collectProblems(&problems, func() { got = renderRequest(test.request, vars, "custom.toml") })
+		if test.err != "" {
+			if len(problems) != 1 || !strings.HasPrefix(problems[0], test.err) {
+				t.Errorf("renderRequest(%q) failed with %q, want %q", test.request, problems, test.err)
+			}
+			continue
+		}
+		if len(problems) > 0 || got != test.want {
+			t.Errorf("renderRequest(%q) = %q, %q, want %q", test.request, got, problems, test.want)
+		}
+	}
+}
+
+func TestExpandRequest(t *testing.T) {
+	// Values of the environment are not templates
+	t.Setenv("DMDB_TEST_FILTER", "NAME = '{{x}}'")
+	problems := []string{}
+	var got string
+	collectProblems(&problems, func() {
+		got = expandRequest("SELECT * FROM {{.Schema}}.T WHERE ${DMDB_TEST_FILTER}", map[string]string{"Schema": "APP"}, "custom.toml")
+	})
+	if want := "SELECT * FROM APP.T WHERE NAME = '{{x}}'"; len(problems) > 0 || got != want {
+		t.Errorf("expandRequest = %q, %q, want %q", got, problems, want)
+	}
+}
+
+func TestCheckMetricsFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		loaded Metrics
+		want   []string
+	}{
+		{"valid", Metrics{Metric: []Metric{{
+			Context:     "sessions",
+			Labels:      []string{"state"},
+			Request:     "SELECT STATE as state, COUNT(*) as count FROM V$SESSIONS GROUP BY STATE",
+			MetricsDesc: map[string]string{"count": "Number of sessions."},
+		}}}, nil},
+		{"missing fields", Metrics{Metric: []Metric{{}}}, []string{
+			`custom.toml: metric[0] (context ""): missing context`,
+			`custom.toml: metric[0] (context ""): missing request`,
+			`custom.toml: metric[0] (context ""): missing metricsdesc`,
+		}},
+		{"missing columns", Metrics{Metric: []Metric{{
+			Context:       "sessions",
+			Labels:        []string{"state"},
+			FieldToAppend: columnList{"name"},
+			Request:       "SELECT COUNT(*) as count FROM V$SESSIONS",
+			MetricsDesc:   map[string]string{"count": "Number of sessions.", "active": "Active sessions."},
+		}}}, []string{
+			`custom.toml: metric[0] (context "sessions"): column active does not appear in the request`,
+			`custom.toml: metric[0] (context "sessions"): column name does not appear in the request`,
+			`custom.toml: metric[0] (context "sessions"): column state does not appear in the request`,
+		}},
+		// Histograms need a count column, info metrics their infolabels
+		{"types", Metrics{Metric: []Metric{{
+			Context:     "statements",
+			Request:     "SELECT SUM(EXEC_TIME) as sum, SVR_VERSION as version FROM V$SQL_HISTORY, V$INSTANCE",
+			MetricsDesc: map[string]string{"latency": "Latency.", "version_info": "Version."},
+			MetricsType: map[string]string{"latency": "histogram", "version_info": "info"},
+			InfoLabels:  map[string][]string{"version_info": {"version", "mode"}},
+		}}}, []string{
+			`custom.toml: metric[0] (context "statements"): column latency_count or count does not appear in the request`,
+			`custom.toml: metric[0] (context "statements"): column mode does not appear in the request`,
+		}},
+		{"invalid types", Metrics{Metric: []Metric{{
+			Context:     "sessions",
+			Request:     "SELECT COUNT(*) as count, SUM(IDLE) as idle FROM V$SESSIONS",
+			MetricsDesc: map[string]string{"count": "Number of sessions.", "idle": "Idle sessions."},
+			MetricsType: map[string]string{"count": "Counter", "idle": "gauges"},
+		}}}, []string{
+			`custom.toml: metric[0] (context "sessions"): invalid type gauges of column idle, must be gauge, counter, histogram, summary or info`,
+		}},
+		// The columns of SELECT * and of a queryref are checked against the request they read
+		{"select all", Metrics{Metric: []Metric{{
+			Context:     "sessions",
+			Request:     "SELECT * FROM V$SESSIONS",
+			MetricsDesc: map[string]string{"count": "Number of sessions."},
+		}}}, nil},
+		{"queryref", Metrics{
+			Query: []Query{{Name: "sessions", Request: "SELECT COUNT(*) as count FROM V$SESSIONS"}},
+			Metric: []Metric{{
+				Context:     "sessions",
+				QueryRef:    "sessions",
+				MetricsDesc: map[string]string{"count": "Number of sessions.", "idle": "Idle sessions."},
+			}},
+		}, []string{`custom.toml: metric[0] (context "sessions"): column idle does not appear in the request`}},
+		{"unknown queryref", Metrics{Metric: []Metric{{
+			Context:     "sessions",
+			QueryRef:    "sesions",
+			MetricsDesc: map[string]string{"count": "Number of sessions."},
+		}}}, nil},
+	}
+	for _, test := range tests {
+		got := checkMetricsFile("custom.toml", test.loaded)
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("checkMetricsFile(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadMetricsFileDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.toml": `
+[[metric]]
+context = "sessions"
+request = "SELECT COUNT(*) as count FROM V$SESSIONS"
+metricsdesc = { count = "Number of sessions." }
+`,
+		// Same context and metric name in another file for the same versions
+		"b.toml": `
+[[metric]]
+context = "sessions"
+request = "SELECT COUNT(*) as count FROM V$SESSIONS"
+metricsdesc = { count = "Number of sessions." }
+`,
+	}
+	definedIn := make(map[string]string)
+	contextIn := make(map[string][]contextUse)
+	defer func() { metricsToScrap, metricsFiles = Metrics{}, nil }()
+	problems := []string{}
+	for _, name := range []string{"a.toml", "b.toml"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		collectProblems(&problems, func() { loadMetricsFile(path, definedIn, contextIn) })
+	}
+	want := []string{
+		"Context sessions is used in both " + filepath.Join(dir, "a.toml") + " and " + filepath.Join(dir, "b.toml"),
+		"Metric dmdb_sessions_count is defined in both " + filepath.Join(dir, "a.toml") + " and " + filepath.Join(dir, "b.toml"),
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("loadMetricsFile found %q, want %q", problems, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(problems[i], want[i]) {
+			t.Errorf("problem %d = %q, want %q", i, problems[i], want[i])
+		}
+	}
+}
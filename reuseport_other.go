@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails, SO_REUSEPORT being only available on Unix systems.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errors.New("--web.reuse-port is not supported on this platform")
+}
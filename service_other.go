@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// serviceCommand runs platform specific commands. There are none outside of Windows.
+func serviceCommand(command string) bool {
+	return false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Name of the Windows service, also used as event log source.
+const serviceName = "dmdb_exporter"
+
+var (
+	serviceCmd       = kingpin.Command("service", "Manage the dmdb_exporter Windows service.")
+	serviceInstall   = serviceCmd.Command("install", "Install the service, running the exporter with the given flags.")
+	serviceUninstall = serviceCmd.Command("uninstall", "Uninstall the service.")
+	serviceStart     = serviceCmd.Command("start", "Start the service.")
+	serviceStop      = serviceCmd.Command("stop", "Stop the service.")
+)
+
+// exporterService runs the exporter under the Windows service control manager.
+type exporterService struct{}
+
+// Execute implements svc.Handler.
+func (exporterService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		run()
+		close(done)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			changes <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Infoln("Stopping dmdb_exporter service")
+			changes <- svc.Status{State: svc.StopPending}
+			close(stopExporter)
+			<-done
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// serviceCommand runs the service management commands and, when the exporter is run
+// by the service control manager, runs it as a service logging to the event log.
+func serviceCommand(command string) bool {
+	var err error
+	switch command {
+	case serviceInstall.FullCommand():
+		err = installService()
+	case serviceUninstall.FullCommand():
+		err = uninstallService()
+	case serviceStart.FullCommand():
+		err = startService()
+	case serviceStop.FullCommand():
+		err = stopService()
+	case runCommand.FullCommand():
+		interactive, err := svc.IsAnInteractiveSession()
+		if err != nil {
+			log.Fatal("Error while detecting the Windows session: ", err)
+		}
+		if interactive {
+			return false
+		}
+		if err := log.Base().SetFormat("logger:eventlog?name=" + serviceName); err != nil {
+			log.Errorln("Error while logging to the event log:", err)
+		}
+		if err := svc.Run(serviceName, exporterService{}); err != nil {
+			log.Fatal("Error while running the service: ", err)
+		}
+		return true
+	default:
+		return false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return true
+}
+
+// serviceArgs returns the command line the service runs with: the flags given to
+// "service install", without the command itself.
+func serviceArgs() []string {
+	args := []string{}
+	skip := map[string]bool{"service": true, "install": true}
+	for _, arg := range os.Args[1:] {
+		if skip[arg] {
+			delete(skip, arg)
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+func installService() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("Service " + serviceName + " already exists")
+	}
+	s, err := m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName: "DM DB Exporter",
+		Description: "Prometheus exporter for DM databases.",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs()...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	log.Infoln("Successfully installed service " + serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("Service " + serviceName + " is not installed")
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		return err
+	}
+	log.Infoln("Successfully uninstalled service " + serviceName)
+	return nil
+}
+
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("Service " + serviceName + " is not installed")
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("Service " + serviceName + " is not installed")
+	}
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	timeout := time.Now().Add(10 * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(timeout) {
+			return errors.New("Timeout waiting for service " + serviceName + " to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// snapshotGatherer scrapes the collectors in the background at a fixed interval and serves
+// the metrics of the last scrape, so that the load on the database does not depend on how
+// often, or by how many servers, the exporter is scraped.
+type snapshotGatherer struct {
+	mu       sync.RWMutex
+	families []*dto.MetricFamily
+	err      error
+	ready    bool
+	// Start of the scrape the snapshot comes from
+	time prometheus.Gauge
+}
+
+func newSnapshotGatherer() *snapshotGatherer {
+	return &snapshotGatherer{
+		time: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "snapshot_timestamp_seconds",
+			Help:      "Start of the background scrape the metrics served come from, in unixtime.",
+		}),
+	}
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *snapshotGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.families, g.err
+}
+
+// hasSnapshot tells whether the first background scrape is over.
+func (g *snapshotGatherer) hasSnapshot() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.ready
+}
+
+// run scrapes the collectors every interval, each scrape lasting at most timeout unless 0.
+// Each scrape starts up to jitter late, so that exporters started together, e.g. against
+// the instances of a cluster, do not query them in the same second.
+func (g *snapshotGatherer) run(collectors []contextCollector, interval, jitter, timeout time.Duration) {
+	// Seeded, the default source giving the same delays to every exporter
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for start := time.Now(); ; start = start.Add(interval) {
+		if time.Since(start) > interval {
+			// Too late after a slow scrape, skip the missed ones
+			start = time.Now()
+		}
+		delay := time.Until(start)
+		if jitter > 0 {
+			delay += time.Duration(random.Int63n(int64(jitter)))
+		}
+		time.Sleep(delay)
+		g.scrape(collectors, timeout)
+	}
+}
+
+func (g *snapshotGatherer) scrape(collectors []contextCollector, timeout time.Duration) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, newRequestID())
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	g.time.SetToCurrentTime()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(g.time)
+	for _, collector := range collectors {
+		registry.MustRegister(requestCollector{ctx: ctx, collector: collector})
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		log.Errorln("Error while scraping in the background:", err)
+	}
+	g.mu.Lock()
+	g.families, g.err, g.ready = families, err, true
+	g.mu.Unlock()
+}
+
+// resultCache serves the metrics of the last scrape to the requests arriving less than an
+// interval after it started, e.g. from both servers of a Prometheus HA pair.
+type resultCache struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	collectors []contextCollector
+	// Maximum duration of a scrape, 0 for no limit
+	timeout  time.Duration
+	started  time.Time
+	families []*dto.MetricFamily
+	err      error
+}
+
+// gather returns the metrics of the last scrape when recent enough, else scrapes the collectors.
+// Requests arriving during a scrape wait for it and share its metrics. As they share it, the
+// scrape does not follow the context of the request starting it, which could be canceled first.
+func (c *resultCache) gather(requestID string) ([]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started.IsZero() && time.Since(c.started) < c.interval {
+		return c.families, c.err
+	}
+	ctx := context.WithValue(context.Background(), requestIDKey{}, requestID)
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	registry := prometheus.NewRegistry()
+	for _, collector := range c.collectors {
+		registry.MustRegister(requestCollector{ctx: ctx, collector: collector})
+	}
+	c.started = time.Now()
+	c.families, c.err = registry.Gather()
+	return c.families, c.err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Version of the format of the state files. States written by a newer exporter are ignored.
+const stateVersion = 1
+
+// stateStore keeps the state that must survive a restart in a directory, one JSON file per
+// feature. A nil store keeps nothing.
+type stateStore struct {
+	dir string
+}
+
+// stateFile is the envelope of a state on disk.
+type stateFile struct {
+	Version int             `json:"version"`
+	Saved   time.Time       `json:"saved"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func openStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &stateStore{dir: dir}, nil
+}
+
+func (s *stateStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// load reads the state saved under name into v and tells whether there was one. A state that
+// cannot be read back is moved aside with a .corrupt suffix, so that the exporter starts afresh.
+func (s *stateStore) load(name string, v interface{}) bool {
+	if s == nil {
+		return false
+	}
+	content, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		log.Errorln("Error while reading the", name, "state:", err)
+		return false
+	}
+	var file stateFile
+	if err = json.Unmarshal(content, &file); err == nil && file.Version > stateVersion {
+		log.Warnln("Ignoring the", name, "state written in version", file.Version, "of the format by a newer exporter")
+		return false
+	}
+	if err == nil {
+		err = json.Unmarshal(file.Data, v)
+	}
+	if err != nil {
+		corrupt := s.path(name) + ".corrupt-" + strconv.FormatInt(time.Now().Unix(), 10)
+		log.Errorln("Corrupt", name, "state, moved to", corrupt+":", err)
+		if err := os.Rename(s.path(name), corrupt); err != nil {
+			log.Errorln("Error while moving the", name, "state aside:", err)
+		}
+		return false
+	}
+	return true
+}
+
+// save writes v as the state saved under name. The state is written to a temporary file first,
+// so that a crash cannot leave a partial state behind.
+func (s *stateStore) save(name string, v interface{}) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(stateFile{Version: stateVersion, Saved: time.Now(), Data: data}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, name+".json.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+// remove deletes the state saved under name, if any.
+func (s *stateStore) remove(name string) error {
+	if s == nil {
+		return nil
+	}
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}